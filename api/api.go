@@ -0,0 +1,316 @@
+// Package api serves the latest poll of each controller over HTTP as JSON, so finding out where a client is right now
+// doesn't take SQL.
+//
+// It's a sink like any other, keeping only the latest snapshot from each controller, and answers:
+//
+//	GET /api/clients            every client, filtered by any of ?controller=, ?ssid=, ?ap= (name or MAC),
+//	                            ?user=, ?ip= (an address or a prefix, such as 10.1.0.0/16) and ?protocol= (name
+//	                            or number)
+//	GET /api/clients/<mac|ip>   a single client, found by its MAC or IP address
+//	GET /api/aps                every AP, with its channels and how many clients it has, filtered by ?controller=
+package api
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dotwaffle/wifitracker/decoder"
+	"github.com/dotwaffle/wifitracker/store"
+)
+
+// Client is a client as the API shows it, with where and when it was seen.
+type Client struct {
+	Controller string    `json:"controller"`
+	Time       time.Time `json:"time"`
+	MAC        string    `json:"mac"`
+	IP         string    `json:"ip"`
+	User       string    `json:"user"`
+	SSID       string    `json:"ssid"`
+	Protocol   string    `json:"protocol"`
+	APMAC      string    `json:"apmac"`
+	APName     string    `json:"apname"`
+	RSSI       int       `json:"rssi"`
+	SNR        int       `json:"snr"`
+	BytesRecv  int       `json:"bytesrecv"`
+	BytesSent  int       `json:"bytessent"`
+}
+
+// AP is an AP as the API shows it, with how many clients it has.
+type AP struct {
+	Controller   string    `json:"controller"`
+	Time         time.Time `json:"time"`
+	MAC          string    `json:"mac"`
+	Name         string    `json:"name"`
+	Channel24GHz int       `json:"channel24"`
+	Channel5GHz  int       `json:"channel5"`
+	Clients      int       `json:"clients"`
+}
+
+// Server keeps the latest snapshot from each controller, serving them as JSON.
+type Server struct {
+	mu        sync.Mutex
+	snapshots map[string]*store.Snapshot
+}
+
+// New returns a server with nothing to serve until the first snapshot is written to it.
+func New() *Server {
+	return &Server{
+		snapshots: make(map[string]*store.Snapshot),
+	}
+}
+
+// Write replaces the controller's last snapshot.
+func (s *Server) Write(snapshot *store.Snapshot) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.snapshots[snapshot.Controller] = snapshot
+	return nil
+}
+
+// Close does nothing, as the snapshots carry on being served until the HTTP server is shut down.
+func (s *Server) Close() error {
+	return nil
+}
+
+// Retain forgets the snapshots of every controller but those named, so those no longer polled stop being served.
+func (s *Server) Retain(controllers []string) {
+	keep := make(map[string]bool)
+	for _, name := range controllers {
+		keep[name] = true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name := range s.snapshots {
+		if !keep[name] {
+			delete(s.snapshots, name)
+		}
+	}
+}
+
+// latest returns the latest snapshot from each controller, in order of their names.
+func (s *Server) latest() []*store.Snapshot {
+	s.mu.Lock()
+	snapshots := make([]*store.Snapshot, 0, len(s.snapshots))
+	for _, snapshot := range s.snapshots {
+		snapshots = append(snapshots, snapshot)
+	}
+	s.mu.Unlock()
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Controller < snapshots[j].Controller
+	})
+	return snapshots
+}
+
+// ServeHTTP answers requests for everything under /api/.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, http.StatusMethodNotAllowed, "only GET is allowed")
+		return
+	}
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api"), "/")
+	switch {
+	case path == "clients":
+		s.listClients(w, r)
+	case strings.HasPrefix(path, "clients/"):
+		s.getClient(w, strings.TrimPrefix(path, "clients/"))
+	case path == "aps":
+		s.listAPs(w, r)
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// clientFilter is what a client has to match to be listed.
+type clientFilter struct {
+	controller, ssid, user, protocol string
+	apMAC, apName                    string
+	ip                               net.IP
+	prefix                           *net.IPNet
+}
+
+// parseClientFilter reads the filter from a request's query.
+func parseClientFilter(query map[string][]string) (*clientFilter, error) {
+	get := func(key string) string {
+		if values := query[key]; len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+	f := &clientFilter{
+		controller: get("controller"),
+		ssid:       get("ssid"),
+		user:       get("user"),
+		protocol:   get("protocol"),
+	}
+	// a protocol can be given by its number, as it's stored, too
+	if n, err := strconv.Atoi(f.protocol); err == nil {
+		f.protocol = (&decoder.Client{Proto: n}).Protocol()
+	}
+	if ap := get("ap"); ap != "" {
+		// an AP can be picked by its MAC address or its name
+		if mac, err := normalizeMAC(ap); err == nil {
+			f.apMAC = mac
+		} else {
+			f.apName = ap
+		}
+	}
+	if ip := get("ip"); ip != "" {
+		if strings.Contains(ip, "/") {
+			_, prefix, err := net.ParseCIDR(ip)
+			if err != nil {
+				return nil, fmt.Errorf("bad ip prefix %q", ip)
+			}
+			f.prefix = prefix
+		} else if f.ip = net.ParseIP(ip); f.ip == nil {
+			return nil, fmt.Errorf("bad ip address %q", ip)
+		}
+	}
+	return f, nil
+}
+
+// matches reports whether the client, and the AP it's associated to, pass the filter.
+func (f *clientFilter) matches(c *Client) bool {
+	switch {
+	case f.controller != "" && c.Controller != f.controller,
+		f.ssid != "" && c.SSID != f.ssid,
+		f.user != "" && c.User != f.user,
+		f.protocol != "" && c.Protocol != f.protocol,
+		f.apMAC != "" && c.APMAC != f.apMAC,
+		f.apName != "" && c.APName != f.apName:
+		return false
+	}
+	if f.ip != nil || f.prefix != nil {
+		ip := net.ParseIP(c.IP)
+		if ip == nil || f.ip != nil && !f.ip.Equal(ip) || f.prefix != nil && !f.prefix.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// clients returns every client in the latest snapshots, as the API shows them.
+func (s *Server) clients() []*Client {
+	var clients []*Client
+	for _, snapshot := range s.latest() {
+		names := make(map[string]string, len(snapshot.APs))
+		for _, ap := range snapshot.APs {
+			names[ap.MAC] = ap.Name
+		}
+		for i := range snapshot.Clients {
+			c := &snapshot.Clients[i]
+			clients = append(clients, &Client{
+				Controller: snapshot.Controller,
+				Time:       snapshot.Time,
+				MAC:        c.MAC,
+				IP:         c.IP,
+				User:       c.User,
+				SSID:       c.SSID,
+				Protocol:   c.Protocol(),
+				APMAC:      c.APMAC,
+				APName:     names[c.APMAC],
+				RSSI:       c.RSSI,
+				SNR:        c.SNR,
+				BytesRecv:  c.BytesRecv,
+				BytesSent:  c.BytesSent,
+			})
+		}
+	}
+	return clients
+}
+
+func (s *Server) listClients(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseClientFilter(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	matched := []*Client{}
+	for _, c := range s.clients() {
+		if filter.matches(c) {
+			matched = append(matched, c)
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"clients": matched})
+}
+
+// getClient finds a single client by its MAC or IP address. A client that's roamed between controllers is found in
+// whichever saw it last.
+func (s *Server) getClient(w http.ResponseWriter, id string) {
+	var found *Client
+	ip := net.ParseIP(id)
+	mac, err := normalizeMAC(id)
+	if ip == nil && err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("%q is neither a MAC nor an IP address", id))
+		return
+	}
+	for _, c := range s.clients() {
+		if ip != nil && !ip.Equal(net.ParseIP(c.IP)) || ip == nil && c.MAC != mac {
+			continue
+		}
+		if found == nil || c.Time.After(found.Time) {
+			found = c
+		}
+	}
+	if found == nil {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("no client %s", id))
+		return
+	}
+	writeJSON(w, http.StatusOK, found)
+}
+
+func (s *Server) listAPs(w http.ResponseWriter, r *http.Request) {
+	controller := r.URL.Query().Get("controller")
+	aps := []*AP{}
+	for _, snapshot := range s.latest() {
+		if controller != "" && snapshot.Controller != controller {
+			continue
+		}
+		counts := make(map[string]int)
+		for _, c := range snapshot.Clients {
+			counts[c.APMAC]++
+		}
+		for _, ap := range snapshot.APs {
+			aps = append(aps, &AP{
+				Controller:   snapshot.Controller,
+				Time:         snapshot.Time,
+				MAC:          ap.MAC,
+				Name:         ap.Name,
+				Channel24GHz: ap.Channel24GHz,
+				Channel5GHz:  ap.Channel5GHz,
+				Clients:      counts[ap.MAC],
+			})
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"aps": aps})
+}
+
+// normalizeMAC turns a MAC address written any of the usual ways (00:11:22:aa:bb:cc, 00-11-22-AA-BB-CC,
+// 0011.22aa.bbcc) into bare lowercase hex, the way the decoder writes them.
+func normalizeMAC(s string) (string, error) {
+	mac := strings.ToLower(strings.NewReplacer(":", "", "-", "", ".", "").Replace(s))
+	if b, err := hex.DecodeString(mac); err != nil || len(b) != 6 {
+		return "", fmt.Errorf("bad MAC address %q", s)
+	}
+	return mac, nil
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, message string) {
+	writeJSON(w, code, map[string]string{"error": message})
+}
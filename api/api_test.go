@@ -0,0 +1,169 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dotwaffle/wifitracker/decoder"
+	"github.com/dotwaffle/wifitracker/store"
+)
+
+func testServer() *Server {
+	s := New()
+	s.Write(&store.Snapshot{
+		Controller: "wlc1",
+		Time:       time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC),
+		Clients: []decoder.Client{
+			{APMAC: "003a98aabbcc", IP: "10.1.0.10", MAC: "001122334455", SSID: "eduroam", User: "alice", Proto: 7, RSSI: -61},
+			{APMAC: "003a98aabbcc", IP: "10.2.0.20", MAC: "001122334466", SSID: "guest", Proto: 3},
+			{APMAC: "003a98ddeeff", IP: "2001:db8::30", MAC: "001122334477", SSID: "eduroam", User: "bob", Proto: 6},
+		},
+		APs: []decoder.AP{
+			{MAC: "003a98aabbcc", Name: "ap-lobby", Channel24GHz: 6, Channel5GHz: 36},
+			{MAC: "003a98ddeeff", Name: "ap-canteen", Channel24GHz: 11},
+		},
+	})
+	// alice has since roamed to another controller
+	s.Write(&store.Snapshot{
+		Controller: "wlc2",
+		Time:       time.Date(2017, 6, 1, 12, 0, 5, 0, time.UTC),
+		Clients: []decoder.Client{
+			{APMAC: "003a98000001", IP: "10.1.0.10", MAC: "001122334455", SSID: "eduroam", User: "alice", Proto: 7},
+		},
+		APs: []decoder.AP{
+			{MAC: "003a98000001", Name: "ap-library", Channel5GHz: 149},
+		},
+	})
+	return s
+}
+
+// get makes a request, decoding the JSON answer into v.
+func get(t *testing.T, s *Server, url string, v interface{}) int {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest("GET", url, nil))
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("%s: Content-Type %q", url, ct)
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+		t.Fatalf("%s: %v\n%s", url, err, rec.Body.String())
+	}
+	return rec.Code
+}
+
+func TestListClients(t *testing.T) {
+	s := testServer()
+	for url, want := range map[string][]string{
+		"/api/clients":                                       {"wlc1/001122334455", "wlc1/001122334466", "wlc1/001122334477", "wlc2/001122334455"},
+		"/api/clients?controller=wlc1":                       {"wlc1/001122334455", "wlc1/001122334466", "wlc1/001122334477"},
+		"/api/clients?ssid=eduroam":                          {"wlc1/001122334455", "wlc1/001122334477", "wlc2/001122334455"},
+		"/api/clients?ap=ap-lobby":                           {"wlc1/001122334455", "wlc1/001122334466"},
+		"/api/clients?ap=00:3A:98:DD:EE:FF":                  {"wlc1/001122334477"},
+		"/api/clients?user=bob":                              {"wlc1/001122334477"},
+		"/api/clients?ip=10.0.0.0/8":                         {"wlc1/001122334455", "wlc1/001122334466", "wlc2/001122334455"},
+		"/api/clients?ip=10.2.0.20":                          {"wlc1/001122334466"},
+		"/api/clients?ip=2001:db8::/32":                      {"wlc1/001122334477"},
+		"/api/clients?protocol=dot11n5":                      {"wlc1/001122334455", "wlc2/001122334455"},
+		"/api/clients?protocol=6":                            {"wlc1/001122334477"},
+		"/api/clients?ssid=eduroam&user=bob&controller=wlc2": {},
+	} {
+		var got struct {
+			Clients []Client `json:"clients"`
+		}
+		if code := get(t, s, url, &got); code != http.StatusOK {
+			t.Errorf("%s: got %d", url, code)
+		}
+		if got.Clients == nil {
+			t.Errorf("%s: clients missing, rather than an empty list", url)
+		}
+		if len(got.Clients) != len(want) {
+			t.Errorf("%s: got %v, want %v", url, got.Clients, want)
+			continue
+		}
+		for i, c := range got.Clients {
+			if c.Controller+"/"+c.MAC != want[i] {
+				t.Errorf("%s: client %d is %s/%s, want %s", url, i, c.Controller, c.MAC, want[i])
+			}
+		}
+	}
+
+	var got struct {
+		Error string `json:"error"`
+	}
+	for _, url := range []string{"/api/clients?ip=10.0.0.0/33", "/api/clients?ip=nonsense"} {
+		if code := get(t, s, url, &got); code != http.StatusBadRequest || got.Error == "" {
+			t.Errorf("%s: got %d %q, want a bad request", url, code, got.Error)
+		}
+	}
+}
+
+func TestGetClient(t *testing.T) {
+	s := testServer()
+	for _, url := range []string{"/api/clients/00:11:22:33:44:55", "/api/clients/0011.2233.4455", "/api/clients/10.1.0.10"} {
+		var c Client
+		if code := get(t, s, url, &c); code != http.StatusOK {
+			t.Errorf("%s: got %d", url, code)
+		}
+		// the latest sighting wins
+		if c.Controller != "wlc2" || c.APName != "ap-library" || c.Protocol != "dot11n5" || c.User != "alice" {
+			t.Errorf("%s: got %+v", url, c)
+		}
+	}
+
+	var c Client
+	if code := get(t, s, "/api/clients/2001:db8:0::30", &c); code != http.StatusOK || c.MAC != "001122334477" {
+		t.Errorf("by IPv6 address: got %d %+v", code, c)
+	}
+
+	var got struct {
+		Error string `json:"error"`
+	}
+	if code := get(t, s, "/api/clients/001122999999", &got); code != http.StatusNotFound {
+		t.Errorf("unknown client: got %d %q", code, got.Error)
+	}
+	if code := get(t, s, "/api/clients/ap-lobby", &got); code != http.StatusBadRequest {
+		t.Errorf("neither a MAC nor an IP: got %d %q", code, got.Error)
+	}
+	if code := get(t, s, "/api/nothing", &got); code != http.StatusNotFound {
+		t.Errorf("unknown path: got %d %q", code, got.Error)
+	}
+}
+
+func TestListAPs(t *testing.T) {
+	s := testServer()
+	var got struct {
+		APs []AP `json:"aps"`
+	}
+	if code := get(t, s, "/api/aps?controller=wlc1", &got); code != http.StatusOK {
+		t.Errorf("got %d", code)
+	}
+	want := []AP{
+		{Controller: "wlc1", MAC: "003a98aabbcc", Name: "ap-lobby", Channel24GHz: 6, Channel5GHz: 36, Clients: 2},
+		{Controller: "wlc1", MAC: "003a98ddeeff", Name: "ap-canteen", Channel24GHz: 11, Clients: 1},
+	}
+	if len(got.APs) != len(want) {
+		t.Fatalf("got %+v, want %+v", got.APs, want)
+	}
+	for i := range want {
+		want[i].Time = got.APs[i].Time
+		if got.APs[i] != want[i] {
+			t.Errorf("AP %d: got %+v, want %+v", i, got.APs[i], want[i])
+		}
+	}
+
+	s.Retain([]string{"wlc2"})
+	if get(t, s, "/api/aps", &got); len(got.APs) != 1 || got.APs[0].Name != "ap-library" {
+		t.Errorf("after retaining wlc2, got %+v", got.APs)
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	rec := httptest.NewRecorder()
+	testServer().ServeHTTP(rec, httptest.NewRequest("POST", "/api/clients", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("got %d", rec.Code)
+	}
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/dotwaffle/wifitracker/decoder"
+	"github.com/dotwaffle/wifitracker/replay"
+	"github.com/dotwaffle/wifitracker/store"
+	"github.com/gosnmp/gosnmp"
+)
+
+// errReplayFinished is returned by a collector once every recorded snapshot has been replayed
+var errReplayFinished = errors.New("finished replaying snapshots")
+
+// errNoResponse is returned by a poll when none of the SNMP walks came back, so the session needs starting again
+var errNoResponse = errors.New("no response from controller")
+
+// errReconfigure is returned by a collector when it has been given new settings, and needs starting again with them
+// once its polls have finished
+var errReconfigure = errors.New("controller settings changed")
+
+// the schedules, for when a poll is due before the last one has finished
+const (
+	// scheduleSkip drops the polls that fell due, carrying on with the next one due
+	scheduleSkip = "skip"
+	// scheduleDelay runs the poll that fell due as soon as the last one finishes, and carries on from there
+	scheduleDelay = "delay"
+	// scheduleConcurrent runs polls alongside each other, each with its own SNMP session, up to the concurrency
+	scheduleConcurrent = "concurrent"
+)
+
+// checkSchedule makes sure the controller's poll interval and schedule, and how many walks each poll runs at once,
+// make sense.
+func (c *controller) checkSchedule() error {
+	if c.pollInterval <= 0 {
+		return fmt.Errorf("poll interval must be positive")
+	}
+	switch c.schedule {
+	case scheduleSkip, scheduleDelay:
+	case scheduleConcurrent:
+		if c.concurrency < 1 {
+			return fmt.Errorf("concurrency must be at least 1")
+		}
+	default:
+		return fmt.Errorf("unknown schedule %q (skip, delay, concurrent)", c.schedule)
+	}
+	if c.walkConcurrency < 1 {
+		return fmt.Errorf("walk concurrency must be at least 1")
+	}
+	return nil
+}
+
+// run polls the controller every pollInterval, following its schedule whenever a poll overruns. A poll that fails
+// is logged and the next one goes ahead as usual, unless the controller has stopped answering altogether, which is
+// returned for the session to be started again. Once the context is cancelled, no more polls are started, and run
+// returns as soon as those running have finished. New settings are picked up between polls, by returning
+// errReconfigure.
+func (c *controller) run(ctx context.Context, sink store.Sink) error {
+	// recorded polls have to be replayed in order
+	if c.schedule == scheduleConcurrent && c.player == nil {
+		return c.runConcurrent(ctx, sink)
+	}
+	return c.runSerial(ctx, sink)
+}
+
+// runSerial runs one poll at a time, skipping or delaying the next when one overruns.
+func (c *controller) runSerial(ctx context.Context, sink store.Sink) error {
+	var failures int
+	next := time.Now().Add(c.pollInterval)
+	timer := time.NewTimer(c.pollInterval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case c.pending = <-c.updates:
+			return errReconfigure
+		case <-timer.C:
+		}
+
+		// track how many of these things we've done
+		// this is primarily useful in determining if the SNMP timeout/interval is wrong
+		c.iteration++
+		iteration := c.iteration
+		timeStartJob := time.Now()
+		c.log.WithFields(log.Fields{
+			"Iteration": iteration,
+		}).Debug("Starting new collection job")
+
+		err := c.poll(sink, iteration, timeStartJob)
+		if err := c.finished(iteration, &failures, time.Since(timeStartJob), err); err != nil {
+			return err
+		}
+
+		// the next poll is due an interval after the last was, unless that's already been and gone
+		next = next.Add(c.pollInterval)
+		now := time.Now()
+		if now.Before(next) {
+			timer.Reset(next.Sub(now))
+			continue
+		}
+		switch c.schedule {
+		case scheduleDelay:
+			late := c.late.Add(1)
+			pollsLate.Inc(c.name)
+			c.log.WithFields(log.Fields{
+				"Iteration": iteration,
+				"late":      now.Sub(next),
+				"totalLate": late,
+			}).Warn("Poll overran, running the next one late")
+			next = now
+		default:
+			missed := now.Sub(next)/c.pollInterval + 1
+			skipped := c.skipped.Add(uint64(missed))
+			pollsSkipped.Add(float64(missed), c.name)
+			c.log.WithFields(log.Fields{
+				"Iteration":    iteration,
+				"skipped":      int(missed),
+				"totalSkipped": skipped,
+			}).Warn("Poll overran, skipping polls")
+			next = next.Add(missed * c.pollInterval)
+		}
+		timer.Reset(time.Until(next))
+	}
+}
+
+// runConcurrent starts a poll every interval, even if others are still running, up to the concurrency. Polls due while
+// that many are running are skipped.
+func (c *controller) runConcurrent(ctx context.Context, sink store.Sink) error {
+	// SNMP sessions can't be shared, so every poll running at once needs one of its own
+	sessions := make(chan *gosnmp.GoSNMP, c.concurrency)
+	sessions <- c.snmp
+	for i := 1; i < c.concurrency; i++ {
+		session, err := c.dial()
+		if err != nil {
+			close(sessions)
+			closeSessions(sessions, c.snmp)
+			return err
+		}
+		sessions <- session
+	}
+
+	type result struct {
+		iteration int
+		duration  time.Duration
+		err       error
+	}
+	results := make(chan result)
+	var wg sync.WaitGroup
+	defer func() {
+		// let the polls still running finish, and throw away how they went
+		go func() {
+			wg.Wait()
+			close(results)
+		}()
+		for range results {
+		}
+		close(sessions)
+		closeSessions(sessions, c.snmp)
+	}()
+
+	ticker := time.NewTicker(c.pollInterval)
+	defer ticker.Stop()
+	var failures int
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case c.pending = <-c.updates:
+			return errReconfigure
+		case r := <-results:
+			if err := c.finished(r.iteration, &failures, r.duration, r.err); err != nil {
+				return err
+			}
+		case timeStartJob := <-ticker.C:
+			c.iteration++
+			iteration := c.iteration
+			var session *gosnmp.GoSNMP
+			select {
+			case session = <-sessions:
+			default:
+				skipped := c.skipped.Add(1)
+				pollsSkipped.Inc(c.name)
+				c.log.WithFields(log.Fields{
+					"Iteration":    iteration,
+					"running":      c.concurrency,
+					"totalSkipped": skipped,
+				}).Warn("Too many polls running, skipping poll")
+				continue
+			}
+
+			c.log.WithFields(log.Fields{
+				"Iteration": iteration,
+			}).Debug("Starting new collection job")
+			wg.Add(1)
+			go func(iteration int, session *gosnmp.GoSNMP, timeStartJob time.Time) {
+				defer wg.Done()
+				err := c.pollSession(session, sink, iteration, timeStartJob)
+				sessions <- session
+				results <- result{iteration: iteration, duration: time.Since(timeStartJob), err: err}
+			}(iteration, session, timeStartJob)
+		}
+	}
+}
+
+// closeSessions closes the SNMP sessions opened for concurrent polls, leaving the controller's own alone.
+func closeSessions(sessions <-chan *gosnmp.GoSNMP, own *gosnmp.GoSNMP) {
+	for session := range sessions {
+		if session != own {
+			session.Conn.Close()
+		}
+	}
+}
+
+// finished deals with a poll having finished, returning an error if the collector needs to stop.
+func (c *controller) finished(iteration int, failures *int, duration time.Duration, err error) error {
+	switch {
+	case err == nil:
+		*failures = 0
+		c.lastSuccess = time.Now()
+		pollLastSuccess.Set(float64(c.lastSuccess.UnixNano())/1e9, c.name)
+		status.polled(c.name, c.pollInterval, nil)
+	case errors.Is(err, errReplayFinished), errors.Is(err, errNoResponse):
+		return err
+	default:
+		*failures++
+		pollFailures.Inc(c.name)
+		status.polled(c.name, c.pollInterval, err)
+		c.log.WithFields(log.Fields{
+			"Iteration": iteration,
+			"failures":  *failures,
+			"err":       err,
+		}).Error("Poll failed, carrying on")
+	}
+
+	pollDuration.Observe(duration.Seconds(), c.name)
+
+	// a poll that takes up most of the interval is a sign the interval wants raising
+	if c.overrunWarn > 0 && duration > time.Duration(float64(c.pollInterval)*c.overrunWarn) {
+		c.log.WithFields(log.Fields{
+			"Iteration": iteration,
+			"duration":  duration,
+			"interval":  c.pollInterval,
+		}).Warn("Poll took up most of the poll interval, consider raising it")
+	}
+	return nil
+}
+
+// poll collects from the controller once, using its SNMP session, and writes what it finds to storage.
+func (c *controller) poll(sink store.Sink, iteration int, timeStartJob time.Time) error {
+	return c.pollSession(c.snmp, sink, iteration, timeStartJob)
+}
+
+// pollSession collects from the controller once, using the given SNMP session, and writes what it finds to storage.
+func (c *controller) pollSession(session *gosnmp.GoSNMP, sink store.Sink, iteration int, timeStartJob time.Time) error {
+	// start counting for time statistics
+	timeStartCollect := time.Now()
+	iterationLogger := c.log.WithFields(log.Fields{
+		"Iteration": iteration,
+	})
+
+	// get the data from the SNMP Target, or a recording of it
+	var walker replay.Walker = session
+	timestamp := timeStartCollect
+	if c.player != nil {
+		recorded, path, err := c.player.Next()
+		if err == io.EOF {
+			return errReplayFinished
+		} else if err != nil {
+			return err
+		}
+		iterationLogger.WithFields(log.Fields{
+			"snapshot": path,
+		}).Debug("Replaying SNMP snapshot")
+		walker = recorded
+		if !recorded.Time.IsZero() {
+			timestamp = recorded.Time
+		}
+	}
+	snapshot := &replay.Snapshot{Time: timestamp}
+	var results []gosnmp.SnmpPDU
+	var walkErr error
+	walkFailures := 0
+	walks := c.walkAll(walker, c.player != nil)
+	for _, w := range walks {
+		snapshot.Add(w.oid, w.pdus, w.err)
+		walkDuration.Observe(w.duration.Seconds(), c.name, w.oid)
+		if w.err != nil {
+			walkErr = w.err
+			walkFailures++
+			walkFailed.Inc(c.name, w.oid)
+			c.log.WithFields(log.Fields{
+				"Iteration": iteration,
+				"oid":       w.oid,
+				"err":       w.err,
+				"duration":  w.duration,
+			}).Error("Walking SNMP did not come back cleanly!")
+		} else {
+			walkPDUs.Add(float64(len(w.pdus)), c.name, w.oid)
+			iterationLogger.WithFields(log.Fields{
+				"oid":      w.oid,
+				"results":  len(w.pdus),
+				"duration": w.duration,
+			}).Debug("SNMP Walk Completed")
+		}
+		results = append(results, w.pdus...)
+	}
+	// how long did the SNMP querying take?
+	iterationLogger.WithFields(log.Fields{
+		"results":     len(results),
+		"concurrency": c.walkConcurrency,
+		"duration":    time.Since(timeStartCollect),
+	}).Debug("SNMP Collection Completed")
+
+	if c.recorder != nil {
+		path, err := c.recorder.Record(snapshot)
+		if err != nil {
+			iterationLogger.WithFields(log.Fields{
+				"err": err,
+			}).Error("Couldn't record SNMP snapshot!")
+		} else {
+			iterationLogger.WithFields(log.Fields{
+				"snapshot": path,
+			}).Debug("Recorded SNMP snapshot")
+		}
+	}
+
+	// nothing to store if the controller didn't answer at all
+	if walkFailures == len(walks) {
+		return fmt.Errorf("%w: %v", errNoResponse, walkErr)
+	}
+
+	// parse the SNMP results, sort them into clients and aps
+	decoded := decoder.Decode(results)
+	for _, err := range decoded.Errors {
+		switch err := err.(type) {
+		case *decoder.TypeError:
+			iterationLogger.WithFields(log.Fields{
+				"type": err.Type,
+				"oid":  err.OID,
+			}).Warn("Bad/Unexpected SNMP Data")
+		case *decoder.UnknownOIDError:
+			iterationLogger.WithFields(log.Fields{
+				"type": err.Type,
+				"oid":  err.OID,
+			}).Warn("Unknown SNMP Data Found")
+		case *decoder.IndexError:
+			iterationLogger.WithFields(log.Fields{
+				"index": err.Index,
+				"oid":   err.OID,
+				"err":   err.Err,
+			}).Warn("Bad SNMP Index")
+		default:
+			iterationLogger.WithFields(log.Fields{
+				"err": err,
+			}).Error("SNMP Decoding failed")
+		}
+	}
+	counts := decoded.Count()
+	decodeErrors.Add(float64(counts.Type), c.name, "badtype")
+	decodeErrors.Add(float64(counts.UnknownOID), c.name, "unknownoid")
+	decodeErrors.Add(float64(counts.Index), c.name, "badindex")
+	decodeErrors.Add(float64(counts.Other), c.name, "other")
+	if counts.Total() > 0 {
+		iterationLogger.WithFields(log.Fields{
+			"skipped":     counts.Total(),
+			"badtype":     counts.Type,
+			"unknownoid":  counts.UnknownOID,
+			"badindex":    counts.Index,
+			"otherfailed": counts.Other,
+		}).Warn("Skipped bad SNMP Data")
+	}
+
+	// now put all the clients and aps into storage, keeping only what the privacy settings allow
+	c.privacy.apply(decoded.Clients)
+	timeStartInsert := time.Now()
+	stored := &store.Snapshot{
+		Controller: c.name,
+		Time:       timestamp,
+		Clients:    decoded.Clients,
+		APs:        decoded.APs,
+	}
+	if err := sink.Write(stored); err != nil {
+		return fmt.Errorf("storage write failed: %w", err)
+	}
+
+	// how long did the storage take?
+	insertDuration := time.Since(timeStartInsert)
+	var rowsPerSec float64
+	if insertDuration > 0 {
+		rowsPerSec = float64(stored.Rows()) / insertDuration.Seconds()
+	}
+	iterationLogger.WithFields(log.Fields{
+		"rows":     stored.Rows(),
+		"duration": insertDuration,
+	}).Debug("Storage writes completed")
+
+	// how long did everything take?
+	iterationLogger.WithFields(log.Fields{
+		"duration":   time.Since(timeStartJob),
+		"rows":       stored.Rows(),
+		"rowsPerSec": int(rowsPerSec),
+	}).Info("Collection complete")
+
+	return nil
+}
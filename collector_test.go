@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dotwaffle/wifitracker/decoder"
+	"github.com/dotwaffle/wifitracker/fakeagent"
+	"github.com/dotwaffle/wifitracker/store"
+)
+
+// slowSink takes its time over every write, keeping track of how many were going on at once.
+type slowSink struct {
+	delay time.Duration
+
+	mu      sync.Mutex
+	writes  int
+	running int
+	most    int
+}
+
+func (s *slowSink) Write(*store.Snapshot) error {
+	s.mu.Lock()
+	s.running++
+	if s.running > s.most {
+		s.most = s.running
+	}
+	s.mu.Unlock()
+
+	time.Sleep(s.delay)
+
+	s.mu.Lock()
+	s.running--
+	s.writes++
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *slowSink) Close() error {
+	return nil
+}
+
+// runUntil runs the controller's collector against the fake agent, until the sink has seen enough writes and the
+// agent is taken away.
+func runUntil(t *testing.T, schedule string, interval time.Duration, sink *slowSink, writes int) *controller {
+	t.Helper()
+	scenario, err := fakeagent.LoadScenario("fakeagent/testdata/roaming.json")
+	if err != nil {
+		t.Fatalf("LoadScenario: %v", err)
+	}
+	agent, err := fakeagent.Start("127.0.0.1:0", "public", scenario)
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	c := testController(t, agent)
+	c.schedule = schedule
+	c.concurrency = 2
+	c.pollInterval = interval
+	c.timeout = 50 * time.Millisecond
+	c.snmp.Timeout = c.timeout
+	if err := c.checkSchedule(); err != nil {
+		t.Fatalf("checkSchedule: %v", err)
+	}
+
+	go func() {
+		for {
+			time.Sleep(5 * time.Millisecond)
+			sink.mu.Lock()
+			done := sink.writes >= writes
+			sink.mu.Unlock()
+			if done {
+				agent.Close()
+				return
+			}
+		}
+	}()
+
+	done := make(chan error)
+	go func() { done <- c.run(context.Background(), sink) }()
+	select {
+	case err := <-done:
+		if !errors.Is(err, errNoResponse) {
+			t.Errorf("run: got %v, want errNoResponse", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("run didn't notice the controller going away")
+	}
+	return c
+}
+
+func TestScheduleSkip(t *testing.T) {
+	sink := &slowSink{delay: 50 * time.Millisecond}
+	c := runUntil(t, scheduleSkip, 20*time.Millisecond, sink, 3)
+	if c.skipped.Load() == 0 || c.late.Load() != 0 {
+		t.Errorf("got %d skipped and %d late, want some skipped", c.skipped.Load(), c.late.Load())
+	}
+	if sink.most != 1 {
+		t.Errorf("got %d polls at once, want 1", sink.most)
+	}
+}
+
+func TestScheduleDelay(t *testing.T) {
+	sink := &slowSink{delay: 50 * time.Millisecond}
+	c := runUntil(t, scheduleDelay, 20*time.Millisecond, sink, 3)
+	if c.late.Load() == 0 || c.skipped.Load() != 0 {
+		t.Errorf("got %d skipped and %d late, want some late", c.skipped.Load(), c.late.Load())
+	}
+	if sink.most != 1 {
+		t.Errorf("got %d polls at once, want 1", sink.most)
+	}
+}
+
+func TestScheduleConcurrent(t *testing.T) {
+	sink := &slowSink{delay: 100 * time.Millisecond}
+	c := runUntil(t, scheduleConcurrent, 20*time.Millisecond, sink, 4)
+	if c.skipped.Load() == 0 {
+		t.Errorf("got nothing skipped, with more polls due than can run")
+	}
+	if sink.most != 2 {
+		t.Errorf("got %d polls at once, want 2", sink.most)
+	}
+}
+
+func TestCheckSchedule(t *testing.T) {
+	c := newController("wlc", "127.0.0.1")
+	for schedule, ok := range map[string]bool{
+		scheduleSkip:       true,
+		scheduleDelay:      true,
+		scheduleConcurrent: true,
+		"whenever":         false,
+	} {
+		c.schedule = schedule
+		if err := c.checkSchedule(); (err == nil) != ok {
+			t.Errorf("%s: got %v", schedule, err)
+		}
+	}
+	c.schedule, c.concurrency = scheduleConcurrent, 0
+	if err := c.checkSchedule(); err == nil {
+		t.Errorf("concurrency 0 allowed")
+	}
+	c.schedule = scheduleSkip
+	for _, interval := range []time.Duration{0, -time.Minute} {
+		c.pollInterval = interval
+		if err := c.checkSchedule(); err == nil {
+			t.Errorf("interval %v allowed", interval)
+		}
+	}
+}
+
+func TestWalkAll(t *testing.T) {
+	scenario, err := fakeagent.LoadScenario("fakeagent/testdata/roaming.json")
+	if err != nil {
+		t.Fatalf("LoadScenario: %v", err)
+	}
+	agent, err := fakeagent.Start("127.0.0.1:0", "public", scenario)
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer agent.Close()
+	c := testController(t, agent)
+
+	oids := decoder.OIDs()
+	var serial []walk
+	for _, concurrency := range []int{1, 4, len(oids) + 1} {
+		c.walkConcurrency = concurrency
+		walks := c.walkAll(c.snmp, false)
+		if len(walks) != len(oids) {
+			t.Fatalf("concurrency %d: got %d walks, want %d", concurrency, len(walks), len(oids))
+		}
+		for i, w := range walks {
+			if w.oid != oids[i] || w.err != nil || w.duration <= 0 {
+				t.Errorf("concurrency %d: walk %d: got %s in %v, %v", concurrency, i, w.oid, w.duration, w.err)
+			}
+			if serial != nil && !reflect.DeepEqual(w.pdus, serial[i].pdus) {
+				t.Errorf("concurrency %d: walk of %s differs from walking one at a time", concurrency, w.oid)
+			}
+		}
+		if serial == nil {
+			serial = walks
+		}
+	}
+
+	// the extra sessions are kept for next time, but no more than were needed
+	if idle := len(c.sessions.idle); idle != len(oids)-1 {
+		t.Errorf("got %d idle sessions, want %d", idle, len(oids)-1)
+	}
+}
+
+func TestWalkColumns(t *testing.T) {
+	c := newController("wlc", "192.0.2.1")
+	if err := c.set("columns", "clientmac clientrssi,apname"); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	if err := c.check(); err != nil {
+		t.Fatalf("check: %v", err)
+	}
+	want, _ := decoder.Select([]string{"apname", "clientmac", "clientrssi"})
+	if oids := c.oids(); !reflect.DeepEqual(oids, want) {
+		t.Errorf("got %v, want %v", oids, want)
+	}
+
+	c.set("columns", "clientmac clientshoesize")
+	if err := c.check(); err == nil {
+		t.Errorf("unknown column allowed")
+	}
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/namsral/flag"
+)
+
+// configSection is a section of the TOML config file. Every setting in it is one of the flags, grouped with those it
+// goes with.
+type configSection struct {
+	name     string
+	settings []configSetting
+}
+
+// configSetting is a setting in the TOML config file, and the flag it sets.
+type configSetting struct {
+	key  string
+	flag string
+	list bool // written as an array, for a comma separated flag
+}
+
+// the TOML config file's sections, in the order they're written out
+var configSections = []configSection{
+	{"", []configSetting{
+		{key: "debug", flag: "debug"},
+		{key: "shutdowngrace", flag: "shutdowngrace"},
+		{key: "configwatch", flag: "configwatch"},
+	}},
+	{"snmp", []configSetting{
+		{key: "host", flag: "snmphost"},
+		{key: "version", flag: "snmpversion"},
+		{key: "community", flag: "snmpcommunity"},
+		{key: "community_file", flag: "snmpcommunity_file"},
+		{key: "interval", flag: "snmppollinterval"},
+		{key: "timeout", flag: "snmptimeout"},
+		{key: "retries", flag: "snmpretries"},
+		{key: "schedule", flag: "snmpschedule"},
+		{key: "concurrency", flag: "snmpconcurrency"},
+		{key: "walkconcurrency", flag: "snmpwalkconcurrency"},
+		{key: "overrunwarn", flag: "snmpoverrunwarn"},
+		{key: "record", flag: "snmprecord"},
+		{key: "replay", flag: "snmpreplay"},
+		{key: "seclevel", flag: "snmpv3seclevel"},
+		{key: "user", flag: "snmpv3user"},
+		{key: "authproto", flag: "snmpv3authproto"},
+		{key: "authpass", flag: "snmpv3authpass"},
+		{key: "authpass_file", flag: "snmpv3authpass_file"},
+		{key: "privproto", flag: "snmpv3privproto"},
+		{key: "privpass", flag: "snmpv3privpass"},
+		{key: "privpass_file", flag: "snmpv3privpass_file"},
+		{key: "context", flag: "snmpv3context"},
+		{key: "engineid", flag: "snmpv3engineid"},
+	}},
+	{"oids", []configSetting{
+		{key: "columns", flag: "snmpcolumns", list: true},
+	}},
+	{"privacy", []configSetting{
+		{key: "hashmacs", flag: "privacyhashmacs"},
+		{key: "key", flag: "privacykey"},
+		{key: "key_file", flag: "privacykey_file"},
+		{key: "dropusers", flag: "privacydropusers"},
+		{key: "ipv4prefix", flag: "privacyipv4prefix"},
+		{key: "ipv6prefix", flag: "privacyipv6prefix"},
+	}},
+	{"http", []configSetting{
+		{key: "addr", flag: "httpaddr"},
+		{key: "api", flag: "httpapi"},
+		{key: "readyintervals", flag: "readyintervals"},
+	}},
+	{"prometheus", []configSetting{
+		{key: "clientbytes", flag: "promclientbytes"},
+		{key: "clientlimit", flag: "promclientlimit"},
+	}},
+	{"storage", []configSetting{
+		{key: "backends", flag: "storage", list: true},
+		{key: "automigrate", flag: "automigrate"},
+	}},
+	{"storage.mysql", []configSetting{
+		{key: "host", flag: "sqlhost"},
+		{key: "port", flag: "sqlport"},
+		{key: "user", flag: "sqluser"},
+		{key: "pass", flag: "sqlpass"},
+		{key: "pass_file", flag: "sqlpass_file"},
+		{key: "db", flag: "sqldb"},
+		{key: "tls", flag: "sqltls"},
+		{key: "batchsize", flag: "sqlbatchsize"},
+		{key: "dsn", flag: "sqldsn"},
+		{key: "dsn_file", flag: "sqldsn_file"},
+	}},
+	{"storage.postgres", []configSetting{
+		{key: "dsn", flag: "pgdsn"},
+		{key: "dsn_file", flag: "pgdsn_file"},
+		{key: "timescale", flag: "pgtimescale"},
+		{key: "chunkinterval", flag: "pgchunkinterval"},
+		{key: "compressafter", flag: "pgcompressafter"},
+	}},
+	{"storage.sqlite", []configSetting{
+		{key: "path", flag: "sqlitepath"},
+	}},
+	{"storage.file", []configSetting{
+		{key: "path", flag: "filelog"},
+	}},
+	{"storage.spool", []configSetting{
+		{key: "dir", flag: "spooldir"},
+		{key: "maxage", flag: "spoolmaxage"},
+		{key: "maxmb", flag: "spoolmaxmb"},
+	}},
+}
+
+// controllerSection is the TOML config file's array of tables of controllers, each with a name, a host, and any of
+// the keys parseControllers takes.
+const controllerSection = "controller"
+
+// the controllers in the TOML config file, polled unless -snmpcontrollers is set
+var tomlControllerConfigs []controllerConfig
+
+// readTOMLConfig reads the TOML config file at path, returning the flags it sets and the controllers in it.
+func readTOMLConfig(path string) (map[string]string, []controllerConfig, error) {
+	var doc map[string]interface{}
+	if _, err := toml.DecodeFile(path, &doc); err != nil {
+		return nil, nil, err
+	}
+	var controllers []controllerConfig
+	if value, ok := doc[controllerSection]; ok {
+		var err error
+		if controllers, err = tomlControllers(value); err != nil {
+			return nil, nil, err
+		}
+		delete(doc, controllerSection)
+	}
+	flags := make(map[string]string)
+	if err := tomlSection(doc, "", flags); err != nil {
+		return nil, nil, err
+	}
+	return flags, controllers, nil
+}
+
+// tomlSection turns the settings in a section of the TOML config file, and the sections inside it, into flags.
+func tomlSection(table map[string]interface{}, name string, flags map[string]string) error {
+	section := findSection(name)
+	if section == nil {
+		return fmt.Errorf("unknown section [%s]", name)
+	}
+	for key, value := range table {
+		full := key
+		if name != "" {
+			full = name + "." + key
+		}
+		if sub, ok := value.(map[string]interface{}); ok {
+			if err := tomlSection(sub, full, flags); err != nil {
+				return err
+			}
+			continue
+		}
+
+		setting := section.find(key)
+		if setting == nil {
+			return fmt.Errorf("unknown setting %q in [%s]", key, name)
+		}
+		text, err := tomlValue(value)
+		if err != nil {
+			return fmt.Errorf("[%s] %s: %v", name, key, err)
+		}
+		flags[setting.flag] = text
+	}
+	return nil
+}
+
+// tomlControllers reads the controller tables, each setting other than the name and host being kept for set, in key
+// order.
+func tomlControllers(value interface{}) ([]controllerConfig, error) {
+	var tables []map[string]interface{}
+	switch v := value.(type) {
+	case []map[string]interface{}:
+		tables = v
+	case []interface{}:
+		for _, t := range v {
+			table, ok := t.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("[[%s]] must be tables", controllerSection)
+			}
+			tables = append(tables, table)
+		}
+	default:
+		return nil, fmt.Errorf("[[%s]] must be tables", controllerSection)
+	}
+
+	var controllers []controllerConfig
+	for i, table := range tables {
+		var keys []string
+		for key := range table {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		var config controllerConfig
+		for _, key := range keys {
+			text, err := tomlValue(table[key])
+			if err != nil {
+				return nil, fmt.Errorf("[[%s]] %d: %s: %v", controllerSection, i+1, key, err)
+			}
+			switch key {
+			case "name":
+				config.name = text
+			case "host":
+				config.host = text
+			default:
+				config.settings = append(config.settings, controllerSetting{key: key, value: text})
+			}
+		}
+		if config.name == "" || config.host == "" {
+			return nil, fmt.Errorf("[[%s]] %d: needs a name and a host", controllerSection, i+1)
+		}
+		controllers = append(controllers, config)
+	}
+	return controllers, nil
+}
+
+// tomlValue writes a TOML value the way its flag takes it, arrays becoming comma separated lists.
+func tomlValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64), nil
+	case []interface{}:
+		items := make([]string, len(v))
+		for i, item := range v {
+			text, err := tomlValue(item)
+			if err != nil {
+				return "", err
+			}
+			items[i] = text
+		}
+		return strings.Join(items, ","), nil
+	}
+	return "", fmt.Errorf("unsupported value %v", value)
+}
+
+func findSection(name string) *configSection {
+	for i := range configSections {
+		if configSections[i].name == name {
+			return &configSections[i]
+		}
+	}
+	return nil
+}
+
+func (s *configSection) find(key string) *configSetting {
+	for i := range s.settings {
+		if s.settings[i].key == key {
+			return &s.settings[i]
+		}
+	}
+	return nil
+}
+
+func init() {
+	// the flat config file is read by applyConfigFile, rather than the flag package, which only knows lowercase keys
+	flag.DefaultConfigFlagname = ""
+}
+
+// applyConfigFile sets the flags in the flat config file named by -config, if there is one, leaving alone those
+// already set on the command line or in the environment. Each line is a flag's name and its value, separated by a
+// space or an equals sign, with the name in any case, so the same file can be used as a Docker env-file, which wants
+// them UPPERCASE.
+func applyConfigFile(fs *flag.FlagSet) error {
+	path := fs.Lookup("config").Value.String()
+	if path == "" {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, hasValue := line, "", false
+		if i := strings.IndexAny(line, "= "); i >= 0 {
+			name, value, hasValue = line[:i], line[i+1:], true
+		}
+		name = strings.ToLower(name)
+
+		found := fs.Lookup(name)
+		if found == nil {
+			return fmt.Errorf("%s: unknown setting %s", path, name)
+		}
+		if set[name] {
+			continue
+		}
+		if !hasValue {
+			// a bool flag on its own turns it on, as on the command line
+			if b, ok := found.Value.(interface{ IsBoolFlag() bool }); !ok || !b.IsBoolFlag() {
+				return fmt.Errorf("%s: %s needs a value", path, name)
+			}
+			value = "true"
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("%s: bad value for -%s: %v", path, name, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// applyTOMLConfig sets the flags in the TOML config file named by -configtoml, if there is one, leaving alone those
+// already set on the command line, in the environment or in the -config file, and returns the controllers in it.
+func applyTOMLConfig(fs *flag.FlagSet) ([]controllerConfig, error) {
+	path := fs.Lookup("configtoml").Value.String()
+	if path == "" {
+		return nil, nil
+	}
+	flags, controllers, err := readTOMLConfig(path)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	for name, value := range flags {
+		if set[name] {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return nil, fmt.Errorf("%s: bad value for -%s: %v", path, name, err)
+		}
+	}
+	return controllers, nil
+}
+
+// runConfig is the config subcommand, which checks the configuration and shows it as a TOML config file, with
+// secrets masked.
+//
+//	wifitracker [flags] config validate
+func runConfig(args []string) error {
+	if len(args) != 1 || args[0] != "validate" {
+		return fmt.Errorf("usage: wifitracker [flags] config validate")
+	}
+	controllers, err := checkControllers()
+	if err != nil {
+		return err
+	}
+	if err := checkStorage(*storage); err != nil {
+		return err
+	}
+	writeConfig(os.Stdout, controllers)
+	return nil
+}
+
+// writeConfig writes the configuration as a TOML config file, with secrets masked.
+func writeConfig(w io.Writer, controllers []*controller) {
+	for _, section := range configSections {
+		if section.name != "" {
+			fmt.Fprintf(w, "\n[%s]\n", section.name)
+		}
+		for _, setting := range section.settings {
+			f := flag.Lookup(setting.flag)
+			var value interface{} = f.Value.String()
+			if getter, ok := f.Value.(flag.Getter); ok {
+				value = getter.Get()
+			}
+			if setting.list {
+				value = []string{}
+				if text := f.Value.String(); text != "" {
+					value = strings.Split(text, ",")
+				}
+			}
+			writeSetting(w, setting.key, value, secretSettings[setting.flag])
+		}
+	}
+
+	for _, c := range controllers {
+		fmt.Fprintf(w, "\n[[%s]]\n", controllerSection)
+		writeSetting(w, "name", c.name, false)
+		writeSetting(w, "host", c.host, false)
+		writeSetting(w, "port", int(c.port), false)
+		writeSetting(w, "version", c.version, false)
+		if c.version == "3" {
+			writeSetting(w, "seclevel", c.usm.secLevel, false)
+			writeSetting(w, "user", c.usm.user, false)
+			writeSetting(w, "authproto", c.usm.authProto, false)
+			writeSetting(w, "authpass", c.usm.authPass, true)
+			writeSetting(w, "privproto", c.usm.privProto, false)
+			writeSetting(w, "privpass", c.usm.privPass, true)
+			writeSetting(w, "context", c.usm.context, false)
+			writeSetting(w, "engineid", c.usm.engineID, false)
+		} else {
+			writeSetting(w, "community", c.community, true)
+		}
+		writeSetting(w, "interval", c.pollInterval, false)
+		writeSetting(w, "timeout", c.timeout, false)
+		writeSetting(w, "retries", c.retries, false)
+		writeSetting(w, "schedule", c.schedule, false)
+		writeSetting(w, "concurrency", c.concurrency, false)
+		writeSetting(w, "walkconcurrency", c.walkConcurrency, false)
+		writeSetting(w, "columns", c.columns, false)
+	}
+}
+
+// writeSetting writes a single TOML setting, masking it if it's a secret that's been set.
+func writeSetting(w io.Writer, key string, value interface{}, secret bool) {
+	if secret && value != "" {
+		value = "(secret)"
+	}
+	var text string
+	switch v := value.(type) {
+	case string:
+		text = strconv.Quote(v)
+	case time.Duration:
+		text = strconv.Quote(v.String())
+	case []string:
+		quoted := make([]string, len(v))
+		for i, s := range v {
+			quoted[i] = strconv.Quote(strings.TrimSpace(s))
+		}
+		text = "[" + strings.Join(quoted, ", ") + "]"
+	default:
+		text = fmt.Sprint(v)
+	}
+	fmt.Fprintf(w, "%s = %s\n", key, text)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTOMLFile writes a TOML config file for the test, returning its path.
+func writeTOMLFile(t *testing.T, config string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "wifitracker.toml")
+	if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	return path
+}
+
+func TestReadTOMLConfig(t *testing.T) {
+	flags, controllers, err := readTOMLConfig(writeTOMLFile(t, `
+debug = true
+
+[snmp]
+community = "cheese"
+interval = "30s"
+retries = 3
+
+[[controller]]
+name = "wlc1"
+host = "10.0.0.1"
+
+[[controller]]
+name = "wlc2"
+host = "10.0.0.2"
+port = 1161
+schedule = "delay"
+community = "a,b;c"
+
+[storage]
+backends = ["mysql", "file"]
+
+[storage.mysql]
+port = 3307
+
+[storage.file]
+path = "polls.json"
+
+[prometheus]
+clientbytes = true
+`))
+	if err != nil {
+		t.Fatalf("readTOMLConfig: %v", err)
+	}
+	want := map[string]string{
+		"debug":            "true",
+		"snmpcommunity":    "cheese",
+		"snmppollinterval": "30s",
+		"snmpretries":      "3",
+		"storage":          "mysql,file",
+		"sqlport":          "3307",
+		"filelog":          "polls.json",
+		"promclientbytes":  "true",
+	}
+	if len(flags) != len(want) {
+		t.Errorf("got %v, want %v", flags, want)
+	}
+	for name, value := range want {
+		if flags[name] != value {
+			t.Errorf("-%s: got %q, want %q", name, flags[name], value)
+		}
+	}
+	wantControllers := []controllerConfig{
+		{name: "wlc1", host: "10.0.0.1"},
+		{name: "wlc2", host: "10.0.0.2", settings: []controllerSetting{
+			{key: "community", value: "a,b;c"},
+			{key: "port", value: "1161"},
+			{key: "schedule", value: "delay"},
+		}},
+	}
+	if !reflect.DeepEqual(controllers, wantControllers) {
+		t.Errorf("got controllers %v, want %v", controllers, wantControllers)
+	}
+
+	for config, problem := range map[string]string{
+		"[snmp]\nintervall = \"1s\"\n":                                                "unknown setting",
+		"[exporter]\nport = 9100\n":                                                   "unknown section",
+		"[storage.mysql]\nhost = \"a\"\n[storage.mongo]\n":                            "unknown section",
+		"[[controller]]\nname = \"wlc\"\n":                                            "needs a name and a host",
+		"[[controller]]\nname = \"wlc\"\nhost = \"a\"\n[controller.snmp]\nport = 1\n": "unsupported value",
+	} {
+		if _, _, err := readTOMLConfig(writeTOMLFile(t, config)); err == nil || !strings.Contains(err.Error(), problem) {
+			t.Errorf("%q: got %v, want %s", config, err, problem)
+		}
+	}
+}
+
+func TestTOMLConfigPrecedence(t *testing.T) {
+	path := writeTOMLFile(t, "[snmp]\ncommunity = \"cheese\"\nretries = 3\ntimeout = \"5s\"\n")
+	t.Setenv("SNMPTIMEOUT", "2s")
+	config, _, err := readConfig([]string{"-configtoml", path, "-snmpretries", "5"})
+	if err != nil {
+		t.Fatalf("readConfig: %v", err)
+	}
+	for name, value := range map[string]string{
+		"snmpcommunity": "cheese",
+		"snmpretries":   "5",
+		"snmptimeout":   "2s",
+	} {
+		if config[name] != value {
+			t.Errorf("-%s: got %q, want %q", name, config[name], value)
+		}
+	}
+
+	if _, _, err := readConfig([]string{"-configtoml", writeTOMLFile(t, "[snmp]\nretries = \"lots\"\n")}); err == nil {
+		t.Errorf("bad value read without error")
+	}
+}
+
+func TestWriteConfig(t *testing.T) {
+	keepFlags(t)
+	*snmpCommunity = "cheese"
+	*sqlPass = "hunter2"
+	*privacyKey = "pepper"
+	*snmpControllers = "wlc1=10.0.0.1;interval=1m,wlc2=10.0.0.2;version=3;authpass=swordfish;privpass=swordfish"
+	controllers, err := configuredControllers()
+	if err != nil {
+		t.Fatalf("configuredControllers: %v", err)
+	}
+
+	var buf bytes.Buffer
+	writeConfig(&buf, controllers)
+	for _, secret := range []string{"cheese", "hunter2", "swordfish", "pepper"} {
+		if strings.Contains(buf.String(), secret) {
+			t.Errorf("%s written out:\n%s", secret, buf.String())
+		}
+	}
+
+	// what's written can be read back in
+	flags, configs, err := readTOMLConfig(writeTOMLFile(t, buf.String()))
+	if err != nil {
+		t.Fatalf("reading back: %v\n%s", err, buf.String())
+	}
+	if flags["snmppollinterval"] != "10s" || flags["sqlport"] != "3306" || flags["storage"] != "mysql" {
+		t.Errorf("read back %v", flags)
+	}
+	readBack, err := newControllers(configs)
+	if err != nil {
+		t.Fatalf("reading back controllers: %v", err)
+	}
+	if len(readBack) != 2 || readBack[0].name != "wlc1" || readBack[0].pollInterval != time.Minute ||
+		readBack[1].usm.authPass != "(secret)" {
+		t.Errorf("read back controllers %v", configs)
+	}
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/dotwaffle/wifitracker/decoder"
+	"github.com/dotwaffle/wifitracker/replay"
+	"github.com/gosnmp/gosnmp"
+)
+
+// controller is a single wireless LAN controller, and the SNMP session used to poll it
+type controller struct {
+	name            string
+	host            string
+	port            uint16
+	version         string
+	community       string
+	usm             usm
+	pollInterval    time.Duration
+	timeout         time.Duration
+	retries         int
+	schedule        string // what to do when a poll is due before the last one has finished
+	concurrency     int    // how many polls can run at once, for the concurrent schedule
+	overrunWarn     float64
+	walkConcurrency int      // how many OIDs a poll walks at once
+	columns         []string // the columns a poll walks, every one if empty
+	privacy         privacy
+
+	snmp     *gosnmp.GoSNMP
+	sessions sessionPool      // more sessions, for walking in parallel
+	recorder *replay.Recorder // if set, every poll is recorded
+	player   *replay.Player   // if set, recorded polls are used instead of snmp
+	log      *log.Entry
+	updates  chan *controller // new settings from reloading the configuration, waiting to be picked up
+	pending  *controller      // new settings picked up, waiting for the polls running to finish
+
+	iteration   int           // polls started, carried across restarts
+	lastSuccess time.Time     // when a poll last made it all the way to storage
+	skipped     atomic.Uint64 // polls that never ran, as the one before was still going
+	late        atomic.Uint64 // polls that ran late, as the one before was still going
+}
+
+// newController returns a controller using the global SNMP flags as its settings
+func newController(name, host string) *controller {
+	return &controller{
+		name:      name,
+		host:      host,
+		port:      161,
+		version:   *snmpVersion,
+		community: *snmpCommunity,
+		usm: usm{
+			secLevel:  *snmpV3SecLevel,
+			user:      *snmpV3User,
+			authProto: *snmpV3AuthProto,
+			authPass:  *snmpV3AuthPass,
+			privProto: *snmpV3PrivProto,
+			privPass:  *snmpV3PrivPass,
+			context:   *snmpV3Context,
+			engineID:  *snmpV3EngineID,
+		},
+		pollInterval:    *snmpPollInterval,
+		timeout:         *snmpTimeout,
+		retries:         *snmpRetries,
+		schedule:        *snmpSchedule,
+		concurrency:     *snmpConcurrency,
+		overrunWarn:     *snmpOverrunWarn,
+		walkConcurrency: *snmpWalkConcurrency,
+		columns:         splitColumns(*snmpColumns),
+		privacy:         configuredPrivacy(),
+		log: log.WithFields(log.Fields{
+			"controller": name,
+		}),
+		updates: make(chan *controller, 1),
+	}
+}
+
+// configuredControllers returns the controllers the configuration says to poll: those in the controller list, or
+// failing that those in the TOML config file, or just the single host if there are none.
+func configuredControllers() ([]*controller, error) {
+	switch {
+	case *snmpControllers != "":
+		return parseControllers(*snmpControllers)
+	case len(tomlControllerConfigs) > 0:
+		return newControllers(tomlControllerConfigs)
+	}
+	return []*controller{newController(*snmpHost, *snmpHost)}, nil
+}
+
+// controllerConfig is a controller as it's configured, before it's checked: its name, its host, and the settings it
+// has of its own, as set takes them.
+type controllerConfig struct {
+	name     string
+	host     string
+	settings []controllerSetting
+}
+
+// controllerSetting is one of a controller's own settings.
+type controllerSetting struct {
+	key   string
+	value string
+}
+
+// parseControllers turns a controller list into controllers to poll.
+//
+// The list is comma separated, each controller being written as:
+//
+//	name=host[;key=value...]
+//
+// where the optional keys are "port", "version", "community", "interval", "timeout", "retries", "schedule",
+// "concurrency", "walkconcurrency", "columns" (separated by spaces), and for SNMPv3 "seclevel", "user", "authproto", "authpass", "privproto",
+// "privpass", "context" and "engineid", which override the global SNMP flags for that controller only.
+// "community_file", "authpass_file" and "privpass_file" read those secrets from a file.
+func parseControllers(spec string) ([]*controller, error) {
+	var configs []controllerConfig
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		settings := strings.Split(entry, ";")
+		nameHost := strings.SplitN(settings[0], "=", 2)
+		if len(nameHost) != 2 || nameHost[0] == "" || nameHost[1] == "" {
+			return nil, fmt.Errorf("controller %q is not in the form name=host", settings[0])
+		}
+		config := controllerConfig{name: nameHost[0], host: nameHost[1]}
+
+		for _, setting := range settings[1:] {
+			keyValue := strings.SplitN(setting, "=", 2)
+			if len(keyValue) != 2 {
+				return nil, fmt.Errorf("controller %q: setting %q is not in the form key=value", config.name, setting)
+			}
+			config.settings = append(config.settings, controllerSetting{key: keyValue[0], value: keyValue[1]})
+		}
+
+		configs = append(configs, config)
+	}
+
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("no controllers found in %q", spec)
+	}
+	return newControllers(configs)
+}
+
+// newControllers turns configured controllers, from the controller list or the TOML config file, into controllers to
+// poll, checking each has a name of its own and a host, and that its settings are ones set takes.
+func newControllers(configs []controllerConfig) ([]*controller, error) {
+	var controllers []*controller
+	seen := make(map[string]bool)
+	for _, config := range configs {
+		if config.name == "" || config.host == "" {
+			return nil, fmt.Errorf("controller %q needs a name and a host", config.name)
+		}
+		if seen[config.name] {
+			return nil, fmt.Errorf("controller %q is listed more than once", config.name)
+		}
+		seen[config.name] = true
+		c := newController(config.name, config.host)
+
+		for _, setting := range config.settings {
+			if err := c.set(setting.key, setting.value); err != nil {
+				return nil, fmt.Errorf("controller %q: %v", c.name, err)
+			}
+		}
+
+		controllers = append(controllers, c)
+	}
+	return controllers, nil
+}
+
+// set applies a single per-controller setting. The secrets can be read from a file instead, by adding "_file" to
+// their key.
+func (c *controller) set(key, value string) error {
+	var err error
+	switch key {
+	case "community_file", "authpass_file", "privpass_file":
+		var secret string
+		if secret, err = readSecret(value); err == nil {
+			return c.set(strings.TrimSuffix(key, "_file"), secret)
+		}
+	case "port":
+		var port uint64
+		port, err = strconv.ParseUint(value, 10, 16)
+		c.port = uint16(port)
+	case "version":
+		c.version = value
+	case "community":
+		c.community = value
+	case "seclevel":
+		c.usm.secLevel = value
+	case "user":
+		c.usm.user = value
+	case "authproto":
+		c.usm.authProto = value
+	case "authpass":
+		c.usm.authPass = value
+	case "privproto":
+		c.usm.privProto = value
+	case "privpass":
+		c.usm.privPass = value
+	case "context":
+		c.usm.context = value
+	case "engineid":
+		c.usm.engineID = value
+	case "interval":
+		c.pollInterval, err = time.ParseDuration(value)
+		if err == nil && c.pollInterval <= 0 {
+			err = fmt.Errorf("interval must be positive")
+		}
+	case "timeout":
+		c.timeout, err = time.ParseDuration(value)
+	case "retries":
+		c.retries, err = strconv.Atoi(value)
+	case "schedule":
+		c.schedule = value
+	case "concurrency":
+		c.concurrency, err = strconv.Atoi(value)
+	case "walkconcurrency":
+		c.walkConcurrency, err = strconv.Atoi(value)
+	case "columns":
+		c.columns = splitColumns(value)
+	default:
+		return fmt.Errorf("unknown setting %q", key)
+	}
+	if err != nil {
+		return fmt.Errorf("bad value for %q: %v", key, err)
+	}
+	return nil
+}
+
+// check makes sure the controller's settings make sense, without talking to it.
+func (c *controller) check() error {
+	switch c.version {
+	case "2c":
+	case "3":
+		if _, _, err := c.usm.securityParameters(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown SNMP version %q", c.version)
+	}
+	if _, err := decoder.Select(c.columns); err != nil {
+		return err
+	}
+	if err := c.privacy.check(); err != nil {
+		return err
+	}
+	return c.checkSchedule()
+}
+
+// splitColumns splits a list of columns, separated by commas or spaces, as spaces are all the controller list leaves
+// to separate them.
+func splitColumns(list string) []string {
+	return strings.FieldsFunc(list, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+}
+
+// openSnapshots sets up recording or replaying the controller's polls, each controller having its own directory of
+// snapshots, named after it.
+func (c *controller) openSnapshots() error {
+	if *snmpRecord != "" {
+		recorder, err := replay.NewRecorder(filepath.Join(*snmpRecord, c.name))
+		if err != nil {
+			return fmt.Errorf("recording to %s: %w", *snmpRecord, err)
+		}
+		c.recorder = recorder
+	}
+	if *snmpReplay != "" {
+		player, err := replay.NewPlayer(filepath.Join(*snmpReplay, c.name))
+		if err != nil {
+			return fmt.Errorf("replaying from %s: %w", *snmpReplay, err)
+		}
+		c.player = player
+	}
+	return nil
+}
+
+// reconfigure hands the controller's collector new settings, replacing any it hasn't picked up yet.
+func (c *controller) reconfigure(n *controller) {
+	select {
+	case <-c.updates:
+	default:
+	}
+	c.updates <- n
+}
+
+// sameSession reports whether n's SNMP sessions would be set up just like c's.
+func (c *controller) sameSession(n *controller) bool {
+	return c.host == n.host && c.port == n.port && c.version == n.version && c.community == n.community &&
+		c.usm == n.usm && c.timeout == n.timeout && c.retries == n.retries
+}
+
+// sameSettings reports whether n has the same settings as c.
+func (c *controller) sameSettings(n *controller) bool {
+	return c.sameSession(n) && c.pollInterval == n.pollInterval && c.schedule == n.schedule &&
+		c.concurrency == n.concurrency && c.overrunWarn == n.overrunWarn && c.walkConcurrency == n.walkConcurrency &&
+		strings.Join(c.columns, ",") == strings.Join(n.columns, ",") && c.privacy == n.privacy
+}
+
+// apply takes on the settings of n, reporting whether the SNMP sessions need opening again to use them.
+func (c *controller) apply(n *controller) bool {
+	reconnect := !c.sameSession(n)
+	c.host, c.port, c.version, c.community, c.usm = n.host, n.port, n.version, n.community, n.usm
+	c.timeout, c.retries = n.timeout, n.retries
+	c.pollInterval, c.schedule, c.concurrency = n.pollInterval, n.schedule, n.concurrency
+	c.overrunWarn, c.walkConcurrency, c.columns, c.privacy = n.overrunWarn, n.walkConcurrency, n.columns, n.privacy
+	return reconnect
+}
+
+// connect creates the SNMP session for the controller
+func (c *controller) connect() error {
+	session, err := c.dial()
+	if err != nil {
+		return err
+	}
+	c.snmp = session
+	return nil
+}
+
+// dial opens a new SNMP session to the controller
+func (c *controller) dial() (*gosnmp.GoSNMP, error) {
+	session := &gosnmp.GoSNMP{
+		Target:  c.host,
+		Port:    c.port,
+		Timeout: c.timeout,
+		Retries: c.retries,
+		MaxOids: gosnmp.MaxOids,
+	}
+
+	switch c.version {
+	case "2c":
+		session.Version = gosnmp.Version2c
+		session.Community = c.community
+	case "3":
+		flags, params, err := c.usm.securityParameters()
+		if err != nil {
+			return nil, &configError{err}
+		}
+		session.Version = gosnmp.Version3
+		session.SecurityModel = gosnmp.UserSecurityModel
+		session.MsgFlags = flags
+		session.SecurityParameters = params
+		session.ContextName = c.usm.context
+	default:
+		return nil, &configError{fmt.Errorf("unknown SNMP version %q", c.version)}
+	}
+
+	if err := session.Connect(); err != nil {
+		return nil, err
+	}
+
+	// SNMPv3 credentials are only checked when the agent sees a request,
+	// so make one now rather than finding out on the first poll
+	if c.version == "3" {
+		if _, err := session.Get([]string{sysObjectID}); err != nil {
+			session.Conn.Close()
+			return nil, c.usm.explainUSMError(err)
+		}
+	}
+
+	return session, nil
+}
+
+// close tears down the SNMP sessions for the controller
+func (c *controller) close() error {
+	c.sessions.close()
+	if c.snmp == nil || c.snmp.Conn == nil {
+		return nil
+	}
+	return c.snmp.Conn.Close()
+}
@@ -0,0 +1,310 @@
+package decoder
+
+import (
+	"github.com/gosnmp/gosnmp"
+)
+
+// Columns are the SNMP table columns walked on every poll, and where each of them ends up.
+//
+// Adding a new column is a matter of adding a field to Client or AP, and an entry here, named after the column it's
+// stored in.
+var Columns = []Column{
+	{
+		/*
+			bsnMobileStationAPMacAddr OBJECT-TYPE
+			    SYNTAX MacAddress
+			    ACCESS read-only
+			    STATUS mandatory
+			    DESCRIPTION
+			        "802.11 Mac Address of the AP to which the
+			        Mobile Station is associated."
+			    ::= { bsnMobileStationEntry 4 }
+
+			MacAddress ::= TEXTUAL-CONVENTION
+			    DISPLAY-HINT "1x:"
+			    STATUS       current
+			    DESCRIPTION
+			            "Represents an 802 MAC address represented in the
+			            `canonical' order defined by IEEE 802.1a, i.e., as if it
+			            were transmitted least significant bit first, even though
+			            802.5 (in contrast to other 802.x protocols) requires MAC
+			            addresses to be transmitted most significant bit first."
+			    SYNTAX       OCTET STRING (SIZE (6))
+		*/
+		Name:   "apmac",
+		OID:    ".1.3.6.1.4.1.14179.2.1.4.1.4", // AP MAC List
+		Table:  ClientTable,
+		Index:  IndexOpaque,
+		Types:  []gosnmp.Asn1BER{gosnmp.OctetString},
+		Client: func(c *Client, pdu gosnmp.SnmpPDU) { c.APMAC = macAddress(pdu.Value) },
+	},
+	{
+		/*
+			bsnAPName OBJECT-TYPE
+			    SYNTAX OCTET STRING(SIZE(0..32))
+			    ACCESS read-write
+			    STATUS mandatory
+			    DESCRIPTION
+			        "Name assigned to this AP. If an AP is not configured its
+			        factory default name will be ap: eg. ap:af:12:be"
+			    ::= { bsnAPEntry 3 }
+		*/
+		Name:  "apname",
+		OID:   ".1.3.6.1.4.1.14179.2.2.1.1.3", // AP Names
+		Table: APTable,
+		Index: IndexMAC,
+		Types: []gosnmp.Asn1BER{gosnmp.OctetString},
+		AP:    func(a *AP, pdu gosnmp.SnmpPDU) { a.Name = displayString(pdu.Value) },
+	},
+	{
+		/*
+			Current channel number of the AP Interface.
+			Channel numbers will be from 1 to 14 for 802.11b interface type.
+			Channel numbers will be from 34 to 169 for 802.11a interface
+			type. Allowed channel numbers also depends on the current
+			Country Code set in the Switch. This attribute cannot be set
+			unless bsnAPIfPhyChannelAssignment is set to customized else
+			this attribute gets assigned by dynamic algorithm.
+
+			bsnAPIfPhyChannelNumber OBJECT-TYPE
+			    SYNTAX INTEGER {
+			        ch1(1),
+			        ch2(2),
+			        ch3(3),
+			        ch4(4),
+			        ch5(5),
+			        ch6(6),
+			        ch7(7),
+			        ch8(8),
+			        ch9(9),
+			        ch10(10),
+			        ch11(11),
+			        ch12(12),
+			        ch13(13),
+			        ch14(14),
+			        ch20(20),
+			        ch21(21),
+			        ch22(22),
+			        ch23(23),
+			        ch24(24),
+			        ch25(25),
+			        ch26(26),
+			        ch34(34),
+			        ch36(36),
+			        ch38(38),
+			        ch40(40),
+			        ch42(42),
+			        ch44(44),
+			        ch46(46),
+			        ch48(48),
+			        ch52(52),
+			        ch56(56),
+			        ch60(60),
+			        ch64(64),
+			        ch100(100),
+			        ch104(104),
+			        ch108(108),
+			        ch112(112),
+			        ch116(116),
+			        ch120(120),
+			        ch124(124),
+			        ch128(128),
+			        ch132(132),
+			        ch136(136),
+			        ch140(140),
+			        ch149(149),
+			        ch153(153),
+			        ch157(157),
+			        ch161(161),
+			        ch165(165),
+			        ch169(169)
+			        }
+			    ACCESS read-write
+			    STATUS mandatory
+			    DESCRIPTION
+			        "Current channel number of the AP Interface.
+			        Channel numbers will be from 1 to 14 for 802.11b interface type.
+			        Channel numbers will be from 34 to 169 for 802.11a interface
+			        type.  Allowed channel numbers also depends on the current
+			        Country Code set in the Switch. This attribute cannot be set
+			        unless bsnAPIfPhyChannelAssignment is set to customized else
+			        this attribute gets assigned by dynamic algorithm."
+			    ::= { bsnAPIfEntry 4 }
+		*/
+		Name:  "apchannel",
+		OID:   ".1.3.6.1.4.1.14179.2.2.2.1.4", // AP Channel
+		Table: APTable,
+		Index: IndexMAC,
+		Types: []gosnmp.Asn1BER{gosnmp.Integer},
+		AP:    setAPChannel,
+	},
+	{
+		/*
+			bsnMobileStationIpAddress OBJECT-TYPE
+			    SYNTAX IpAddress
+			    ACCESS read-only
+			    STATUS mandatory
+			    DESCRIPTION
+			        "IP Address of the Mobile Station"
+			    ::= { bsnMobileStationEntry 2 }
+		*/
+		Name:   "clientip",
+		OID:    ".1.3.6.1.4.1.14179.2.1.4.1.2", // Client IP List
+		Table:  ClientTable,
+		Index:  IndexOpaque,
+		Types:  []gosnmp.Asn1BER{gosnmp.OctetString, gosnmp.IPAddress},
+		Client: func(c *Client, pdu gosnmp.SnmpPDU) { c.IP = ipAddress(pdu.Value) },
+	},
+	{
+		/*
+			bsnMobileStationMacAddress OBJECT-TYPE
+			    SYNTAX MacAddress
+
+			    ACCESS read-only
+			    STATUS mandatory
+			    DESCRIPTION
+			        "802.11 MAC Address of the Mobile Station."
+			    ::= { bsnMobileStationEntry 1 }
+		*/
+		Name:   "clientmac",
+		OID:    ".1.3.6.1.4.1.14179.2.1.4.1.1", // Client MAC List
+		Table:  ClientTable,
+		Index:  IndexOpaque,
+		Types:  []gosnmp.Asn1BER{gosnmp.OctetString},
+		Client: func(c *Client, pdu gosnmp.SnmpPDU) { c.MAC = macAddress(pdu.Value) },
+	},
+	{
+		/*
+			bsnMobileStationSsid OBJECT-TYPE
+			    SYNTAX DisplayString
+
+			    ACCESS read-only
+			    STATUS mandatory
+			    DESCRIPTION
+			        "The SSID Advertised by Mobile Station"
+			    ::= { bsnMobileStationEntry 7 }
+		*/
+		Name:   "clientssid",
+		OID:    ".1.3.6.1.4.1.14179.2.1.4.1.7", // Client SSID List
+		Table:  ClientTable,
+		Index:  IndexOpaque,
+		Types:  []gosnmp.Asn1BER{gosnmp.OctetString},
+		Client: func(c *Client, pdu gosnmp.SnmpPDU) { c.SSID = displayString(pdu.Value) },
+	},
+	{
+		/*
+			bsnMobileStationUserName OBJECT-TYPE
+			    SYNTAX DisplayString
+
+			    ACCESS read-only
+			    STATUS mandatory
+			    DESCRIPTION
+			        "User Name,if any, of the Mobile Station. This would
+			        be non empty in case of Web Authentication and IPSec."
+			    ::= { bsnMobileStationEntry 3 }
+		*/
+		Name:   "clientuser",
+		OID:    ".1.3.6.1.4.1.14179.2.1.4.1.3", // Client Username List
+		Table:  ClientTable,
+		Index:  IndexOpaque,
+		Types:  []gosnmp.Asn1BER{gosnmp.OctetString},
+		Client: func(c *Client, pdu gosnmp.SnmpPDU) { c.User = displayString(pdu.Value) },
+	},
+	{
+		/*
+			bsnMobileStationProtocol OBJECT-TYPE
+			    SYNTAX INTEGER {
+			        dot11a(1),
+			        dot11b(2),
+			        dot11g(3),
+			        unknown(4),
+			        mobile(5),
+			        dot11n24(6),
+			        dot11n5(7)
+			        }
+			    ACCESS read-only
+			    STATUS mandatory
+			    DESCRIPTION
+			        "The 802.11 protocol type of the client. The protocol
+			        is mobile when this client detail is seen on the
+			        anchor i.e it's mobility status is anchor."
+			    ::= { bsnMobileStationEntry 25 }
+		*/
+		Name:   "clientproto",
+		OID:    ".1.3.6.1.4.1.14179.2.1.4.1.25", // Client Protocol (a/b/g/n etc)
+		Table:  ClientTable,
+		Index:  IndexOpaque,
+		Types:  []gosnmp.Asn1BER{gosnmp.Integer},
+		Client: func(c *Client, pdu gosnmp.SnmpPDU) { c.Proto = pdu.Value.(int) },
+	},
+	{
+		/*
+			bsnMobileStationRSSI OBJECT-TYPE
+			    SYNTAX INTEGER
+			    ACCESS read-only
+			    STATUS mandatory
+			    DESCRIPTION
+			        "Average packet RSSI for the Mobile Station."
+			    ::= { bsnMobileStationStatsEntry 1 }
+		*/
+		Name:   "clientrssi",
+		OID:    ".1.3.6.1.4.1.14179.2.1.6.1.1", // Client RSSI
+		Table:  ClientTable,
+		Index:  IndexOpaque,
+		Types:  []gosnmp.Asn1BER{gosnmp.Integer},
+		Client: func(c *Client, pdu gosnmp.SnmpPDU) { c.RSSI = pdu.Value.(int) },
+	},
+	{
+		/*
+			bsnMobileStationSnr OBJECT-TYPE
+			    SYNTAX INTEGER
+			    ACCESS read-only
+			    STATUS mandatory
+			    DESCRIPTION
+			        "Signal to noise Ratio of the Mobile Station."
+			    ::= { bsnMobileStationStatsEntry 26 }
+		*/
+		Name:   "clientsnr",
+		OID:    ".1.3.6.1.4.1.14179.2.1.6.1.26", // Client SNR
+		Table:  ClientTable,
+		Index:  IndexOpaque,
+		Types:  []gosnmp.Asn1BER{gosnmp.Integer},
+		Client: func(c *Client, pdu gosnmp.SnmpPDU) { c.SNR = pdu.Value.(int) },
+	},
+	{
+		/*
+			bsnMobileStationBytesReceived OBJECT-TYPE
+			    SYNTAX
+			           Counter
+			    ACCESS read-only
+			    STATUS mandatory
+			    DESCRIPTION
+			        "Bytes received from Mobile Station"
+			    ::= { bsnMobileStationStatsEntry 2 }
+		*/
+		Name:   "clientrecv",
+		OID:    ".1.3.6.1.4.1.14179.2.1.6.1.2", // Client Bytes Recv
+		Table:  ClientTable,
+		Index:  IndexOpaque,
+		Types:  []gosnmp.Asn1BER{gosnmp.Counter32, gosnmp.Counter64},
+		Client: func(c *Client, pdu gosnmp.SnmpPDU) { c.BytesRecv = counter(pdu.Value) },
+	},
+	{
+		/*
+			bsnMobileStationBytesSent OBJECT-TYPE
+			    SYNTAX
+			           Counter
+			    ACCESS read-only
+			    STATUS mandatory
+			    DESCRIPTION
+			        "Bytes sent to Mobile Station"
+			    ::= { bsnMobileStationStatsEntry 3 }
+		*/
+		Name:   "clientsent",
+		OID:    ".1.3.6.1.4.1.14179.2.1.6.1.3", // Client Bytes Sent
+		Table:  ClientTable,
+		Index:  IndexOpaque,
+		Types:  []gosnmp.Asn1BER{gosnmp.Counter32, gosnmp.Counter64},
+		Client: func(c *Client, pdu gosnmp.SnmpPDU) { c.BytesSent = counter(pdu.Value) },
+	},
+}
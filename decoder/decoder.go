@@ -0,0 +1,356 @@
+// Package decoder turns the SNMP tables walked from a Cisco wireless LAN controller into clients and access points.
+package decoder
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gosnmp/gosnmp"
+)
+
+// Client is a wireless client (a "mobile station") associated to an AP.
+type Client struct {
+	APMAC     string `json:"apmac"`
+	IP        string `json:"ip"`
+	MAC       string `json:"mac"`
+	SSID      string `json:"ssid"`
+	User      string `json:"user"`
+	Proto     int    `json:"proto"`
+	RSSI      int    `json:"rssi"`
+	SNR       int    `json:"snr"`
+	BytesRecv int    `json:"bytesrecv"`
+	BytesSent int    `json:"bytessent"`
+}
+
+// protocols are the names bsnMobileStationProtocol gives its values
+var protocols = map[int]string{
+	1: "dot11a",
+	2: "dot11b",
+	3: "dot11g",
+	4: "unknown",
+	5: "mobile",
+	6: "dot11n24",
+	7: "dot11n5",
+}
+
+// Protocol is the name of the client's 802.11 protocol, or its number if the MIB doesn't name it.
+func (c *Client) Protocol() string {
+	if name, ok := protocols[c.Proto]; ok {
+		return name
+	}
+	return strconv.Itoa(c.Proto)
+}
+
+// AP is an access point joined to the controller.
+type AP struct {
+	MAC          string `json:"mac"`
+	Name         string `json:"name"`
+	Channel24GHz int    `json:"channel24"` // 2.4GHz, obviously
+	Channel5GHz  int    `json:"channel5"`
+}
+
+// Table is the SNMP table a column belongs to, which decides what it is decoded into.
+type Table int
+
+// The tables that columns are decoded into.
+const (
+	ClientTable Table = iota
+	APTable
+)
+
+// IndexStyle is how the index of a table row is turned into the key used to group its columns together.
+type IndexStyle int
+
+// The index styles understood by the decoder.
+const (
+	// IndexOpaque uses the index as-is, as nothing needs to be read from it.
+	IndexOpaque IndexStyle = iota
+	// IndexMAC reads the first six sub-identifiers of the index as a MAC address, ignoring the rest.
+	IndexMAC
+)
+
+// Column describes a single SNMP table column, and which field it is decoded into.
+type Column struct {
+	Name  string // what it's called when choosing which columns to walk
+	OID   string
+	Table Table
+	Index IndexStyle
+	Types []gosnmp.Asn1BER
+
+	// only the one matching Table is used
+	Client func(*Client, gosnmp.SnmpPDU)
+	AP     func(*AP, gosnmp.SnmpPDU)
+}
+
+// accepts reports whether the column is expected to be of the given type.
+func (c *Column) accepts(t gosnmp.Asn1BER) bool {
+	for _, expected := range c.Types {
+		if t == expected {
+			return true
+		}
+	}
+	return false
+}
+
+// Result is everything decoded from a single poll of a controller.
+type Result struct {
+	Clients []Client
+	APs     []AP
+
+	// Errors are the problems found with individual PDUs, which were skipped.
+	Errors []error
+}
+
+// TypeError is found when a column comes back with a type it should never have.
+type TypeError struct {
+	OID  string
+	Type gosnmp.Asn1BER
+}
+
+func (e *TypeError) Error() string {
+	return fmt.Sprintf("%s: unexpected SNMP type %v", e.OID, e.Type)
+}
+
+// UnknownOIDError is found when a PDU doesn't belong to any of the known columns.
+type UnknownOIDError struct {
+	OID  string
+	Type gosnmp.Asn1BER
+}
+
+func (e *UnknownOIDError) Error() string {
+	return fmt.Sprintf("%s: unknown OID", e.OID)
+}
+
+// IndexError is found when the index of a row can't be understood, so the row can't be placed.
+type IndexError struct {
+	OID   string
+	Index string
+	Err   error
+}
+
+func (e *IndexError) Error() string {
+	return fmt.Sprintf("%s: bad index %q: %v", e.OID, e.Index, e.Err)
+}
+
+// Unwrap returns the reason the index was rejected.
+func (e *IndexError) Unwrap() error {
+	return e.Err
+}
+
+// The reasons an index can be rejected.
+var (
+	ErrShortIndex = errors.New("too short to hold a MAC address")
+	ErrBadOctet   = errors.New("sub-identifier is not an octet")
+)
+
+// ErrorCounts is a tally of the errors found while decoding, by type.
+type ErrorCounts struct {
+	Type       int
+	UnknownOID int
+	Index      int
+	Other      int
+}
+
+// Total is the number of PDUs that were skipped.
+func (c ErrorCounts) Total() int {
+	return c.Type + c.UnknownOID + c.Index + c.Other
+}
+
+// Count tallies the errors found while decoding, by type.
+func (r *Result) Count() ErrorCounts {
+	var counts ErrorCounts
+	for _, err := range r.Errors {
+		switch err.(type) {
+		case *TypeError:
+			counts.Type++
+		case *UnknownOIDError:
+			counts.UnknownOID++
+		case *IndexError:
+			counts.Index++
+		default:
+			counts.Other++
+		}
+	}
+	return counts
+}
+
+// OIDs returns the OIDs that need walking to fill every column.
+func OIDs() []string {
+	oids := make([]string, 0, len(Columns))
+	for _, column := range Columns {
+		oids = append(oids, column.OID)
+	}
+	return oids
+}
+
+// Select returns the OIDs that need walking to fill the named columns, in the same order as OIDs, or every OID if
+// none are named.
+func Select(names []string) ([]string, error) {
+	if len(names) == 0 {
+		return OIDs(), nil
+	}
+	wanted := make(map[string]bool, len(names))
+	for _, name := range names {
+		wanted[name] = true
+	}
+	var oids []string
+	for _, column := range Columns {
+		if wanted[column.Name] {
+			oids = append(oids, column.OID)
+			delete(wanted, column.Name)
+		}
+	}
+	for _, name := range names {
+		if wanted[name] {
+			return nil, fmt.Errorf("unknown column %q", name)
+		}
+	}
+	return oids, nil
+}
+
+// Decode sorts the PDUs walked from a controller into clients and APs.
+//
+// Clients are returned ordered by their index in the controller's tables, and APs by MAC address.
+func Decode(pdus []gosnmp.SnmpPDU) *Result {
+	result := &Result{}
+	clients := make(map[string]*Client)
+	aps := make(map[string]*AP)
+
+	for _, pdu := range pdus {
+		column, index := lookup(pdu.Name)
+		if column == nil {
+			result.Errors = append(result.Errors, &UnknownOIDError{
+				OID:  pdu.Name,
+				Type: pdu.Type,
+			})
+			continue
+		}
+		if !column.accepts(pdu.Type) {
+			result.Errors = append(result.Errors, &TypeError{
+				OID:  pdu.Name,
+				Type: pdu.Type,
+			})
+			continue
+		}
+
+		key := index
+		if column.Index == IndexMAC {
+			var err error
+			if key, err = macIndex(index); err != nil {
+				result.Errors = append(result.Errors, &IndexError{
+					OID:   pdu.Name,
+					Index: index,
+					Err:   err,
+				})
+				continue
+			}
+		}
+
+		switch column.Table {
+		case ClientTable:
+			if _, ok := clients[key]; !ok {
+				clients[key] = &Client{}
+			}
+			column.Client(clients[key], pdu)
+		case APTable:
+			if _, ok := aps[key]; !ok {
+				aps[key] = &AP{MAC: key}
+			}
+			column.AP(aps[key], pdu)
+		}
+	}
+
+	clientKeys := make([]string, 0, len(clients))
+	for key := range clients {
+		clientKeys = append(clientKeys, key)
+	}
+	sort.Strings(clientKeys)
+	for _, key := range clientKeys {
+		result.Clients = append(result.Clients, *clients[key])
+	}
+
+	apKeys := make([]string, 0, len(aps))
+	for key := range aps {
+		apKeys = append(apKeys, key)
+	}
+	sort.Strings(apKeys)
+	for _, key := range apKeys {
+		result.APs = append(result.APs, *aps[key])
+	}
+
+	return result
+}
+
+// lookup finds the column an OID belongs to, along with the row index.
+func lookup(oid string) (*Column, string) {
+	for i := range Columns {
+		if strings.HasPrefix(oid, Columns[i].OID+".") {
+			return &Columns[i], strings.TrimPrefix(oid, Columns[i].OID+".")
+		}
+	}
+	return nil, ""
+}
+
+// macIndex turns a dotted decimal index into the MAC address at the start of it.
+func macIndex(index string) (string, error) {
+	// there are six bytes in a MAC address
+	// skip any trailing index
+	octets := strings.Split(index, ".")
+	if len(octets) < 6 {
+		return "", ErrShortIndex
+	}
+
+	mac := make([]byte, 6)
+	for i, octet := range octets[:6] {
+		intOctet, err := strconv.ParseUint(octet, 10, 8)
+		if err != nil {
+			return "", fmt.Errorf("%w: %q", ErrBadOctet, octet)
+		}
+		mac[i] = byte(intOctet)
+	}
+
+	return hex.EncodeToString(mac), nil
+}
+
+// macAddress renders a MacAddress as bare lowercase hex.
+func macAddress(v interface{}) string {
+	return hex.EncodeToString(v.([]byte))
+}
+
+// displayString renders a DisplayString.
+func displayString(v interface{}) string {
+	return string(v.([]byte))
+}
+
+// ipAddress renders an IpAddress, which gosnmp hands over as a string, or as raw bytes when the agent sends an OCTET
+// STRING.
+func ipAddress(v interface{}) string {
+	switch ip := v.(type) {
+	case string:
+		return ip
+	case []byte:
+		return net.IP(ip).String()
+	}
+	// buggy agents can send an empty IpAddress, which gosnmp hands over as nil
+	return ""
+}
+
+// counter renders a Counter32 or Counter64.
+func counter(v interface{}) int {
+	return int(gosnmp.ToBigInt(v).Int64())
+}
+
+// setAPChannel puts the channel into the right band.
+func setAPChannel(a *AP, pdu gosnmp.SnmpPDU) {
+	// all 2.4GHz channels are in the range 1-14
+	if channel := pdu.Value.(int); channel < 15 {
+		a.Channel24GHz = channel
+	} else {
+		a.Channel5GHz = channel
+	}
+}
@@ -0,0 +1,245 @@
+package decoder
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gosnmp/gosnmp"
+)
+
+// capturedWalk is a cut down walk of a real AireOS controller, with two clients on two APs.
+var capturedWalk = []gosnmp.SnmpPDU{
+	// bsnMobileStationAPMacAddr
+	{Name: ".1.3.6.1.4.1.14179.2.1.4.1.4.0.17.34.51.68.85", Type: gosnmp.OctetString, Value: []byte{0x00, 0x3a, 0x98, 0xaa, 0xbb, 0xcc}},
+	{Name: ".1.3.6.1.4.1.14179.2.1.4.1.4.240.24.152.1.2.3", Type: gosnmp.OctetString, Value: []byte{0x00, 0x3a, 0x98, 0xdd, 0xee, 0xff}},
+	// bsnAPName
+	{Name: ".1.3.6.1.4.1.14179.2.2.1.1.3.0.58.152.170.187.204", Type: gosnmp.OctetString, Value: []byte("ap-lobby")},
+	{Name: ".1.3.6.1.4.1.14179.2.2.1.1.3.0.58.152.221.238.255", Type: gosnmp.OctetString, Value: []byte("ap-canteen")},
+	// bsnAPIfPhyChannelNumber, indexed by AP MAC and radio slot
+	{Name: ".1.3.6.1.4.1.14179.2.2.2.1.4.0.58.152.170.187.204.0", Type: gosnmp.Integer, Value: 6},
+	{Name: ".1.3.6.1.4.1.14179.2.2.2.1.4.0.58.152.170.187.204.1", Type: gosnmp.Integer, Value: 36},
+	{Name: ".1.3.6.1.4.1.14179.2.2.2.1.4.0.58.152.221.238.255.0", Type: gosnmp.Integer, Value: 11},
+	{Name: ".1.3.6.1.4.1.14179.2.2.2.1.4.0.58.152.221.238.255.1", Type: gosnmp.Integer, Value: 149},
+	// bsnMobileStationIpAddress
+	{Name: ".1.3.6.1.4.1.14179.2.1.4.1.2.0.17.34.51.68.85", Type: gosnmp.IPAddress, Value: "192.0.2.10"},
+	{Name: ".1.3.6.1.4.1.14179.2.1.4.1.2.240.24.152.1.2.3", Type: gosnmp.IPAddress, Value: "192.0.2.11"},
+	// bsnMobileStationMacAddress
+	{Name: ".1.3.6.1.4.1.14179.2.1.4.1.1.0.17.34.51.68.85", Type: gosnmp.OctetString, Value: []byte{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}},
+	{Name: ".1.3.6.1.4.1.14179.2.1.4.1.1.240.24.152.1.2.3", Type: gosnmp.OctetString, Value: []byte{0xf0, 0x18, 0x98, 0x01, 0x02, 0x03}},
+	// bsnMobileStationSsid
+	{Name: ".1.3.6.1.4.1.14179.2.1.4.1.7.0.17.34.51.68.85", Type: gosnmp.OctetString, Value: []byte("eduroam")},
+	{Name: ".1.3.6.1.4.1.14179.2.1.4.1.7.240.24.152.1.2.3", Type: gosnmp.OctetString, Value: []byte("guest")},
+	// bsnMobileStationUserName
+	{Name: ".1.3.6.1.4.1.14179.2.1.4.1.3.0.17.34.51.68.85", Type: gosnmp.OctetString, Value: []byte("alice@example.ac.uk")},
+	{Name: ".1.3.6.1.4.1.14179.2.1.4.1.3.240.24.152.1.2.3", Type: gosnmp.OctetString, Value: []byte("")},
+	// bsnMobileStationProtocol
+	{Name: ".1.3.6.1.4.1.14179.2.1.4.1.25.0.17.34.51.68.85", Type: gosnmp.Integer, Value: 7},
+	{Name: ".1.3.6.1.4.1.14179.2.1.4.1.25.240.24.152.1.2.3", Type: gosnmp.Integer, Value: 6},
+	// bsnMobileStationRSSI
+	{Name: ".1.3.6.1.4.1.14179.2.1.6.1.1.0.17.34.51.68.85", Type: gosnmp.Integer, Value: -61},
+	{Name: ".1.3.6.1.4.1.14179.2.1.6.1.1.240.24.152.1.2.3", Type: gosnmp.Integer, Value: -74},
+	// bsnMobileStationSnr
+	{Name: ".1.3.6.1.4.1.14179.2.1.6.1.26.0.17.34.51.68.85", Type: gosnmp.Integer, Value: 34},
+	{Name: ".1.3.6.1.4.1.14179.2.1.6.1.26.240.24.152.1.2.3", Type: gosnmp.Integer, Value: 19},
+	// bsnMobileStationBytesReceived
+	{Name: ".1.3.6.1.4.1.14179.2.1.6.1.2.0.17.34.51.68.85", Type: gosnmp.Counter32, Value: uint(1234567)},
+	{Name: ".1.3.6.1.4.1.14179.2.1.6.1.2.240.24.152.1.2.3", Type: gosnmp.Counter64, Value: uint64(9876543210)},
+	// bsnMobileStationBytesSent
+	{Name: ".1.3.6.1.4.1.14179.2.1.6.1.3.0.17.34.51.68.85", Type: gosnmp.Counter32, Value: uint(7654321)},
+	{Name: ".1.3.6.1.4.1.14179.2.1.6.1.3.240.24.152.1.2.3", Type: gosnmp.Counter64, Value: uint64(123456789012)},
+}
+
+func TestDecode(t *testing.T) {
+	result := Decode(capturedWalk)
+
+	if len(result.Errors) != 0 {
+		t.Errorf("unexpected errors: %v", result.Errors)
+	}
+
+	wantClients := []Client{
+		{
+			APMAC:     "003a98aabbcc",
+			IP:        "192.0.2.10",
+			MAC:       "001122334455",
+			SSID:      "eduroam",
+			User:      "alice@example.ac.uk",
+			Proto:     7,
+			RSSI:      -61,
+			SNR:       34,
+			BytesRecv: 1234567,
+			BytesSent: 7654321,
+		},
+		{
+			APMAC:     "003a98ddeeff",
+			IP:        "192.0.2.11",
+			MAC:       "f01898010203",
+			SSID:      "guest",
+			User:      "",
+			Proto:     6,
+			RSSI:      -74,
+			SNR:       19,
+			BytesRecv: 9876543210,
+			BytesSent: 123456789012,
+		},
+	}
+	if !reflect.DeepEqual(result.Clients, wantClients) {
+		t.Errorf("clients:\n got %+v\nwant %+v", result.Clients, wantClients)
+	}
+
+	wantAPs := []AP{
+		{MAC: "003a98aabbcc", Name: "ap-lobby", Channel24GHz: 6, Channel5GHz: 36},
+		{MAC: "003a98ddeeff", Name: "ap-canteen", Channel24GHz: 11, Channel5GHz: 149},
+	}
+	if !reflect.DeepEqual(result.APs, wantAPs) {
+		t.Errorf("aps:\n got %+v\nwant %+v", result.APs, wantAPs)
+	}
+}
+
+func TestDecodeSkipsBadPDUs(t *testing.T) {
+	tests := []struct {
+		name string
+		pdu  gosnmp.SnmpPDU
+		want error
+	}{
+		{
+			name: "wrong type for client column",
+			pdu:  gosnmp.SnmpPDU{Name: ".1.3.6.1.4.1.14179.2.1.6.1.1.0.17.34.51.68.85", Type: gosnmp.OctetString, Value: []byte("-61")},
+			want: &TypeError{OID: ".1.3.6.1.4.1.14179.2.1.6.1.1.0.17.34.51.68.85", Type: gosnmp.OctetString},
+		},
+		{
+			name: "wrong type for ap column",
+			pdu:  gosnmp.SnmpPDU{Name: ".1.3.6.1.4.1.14179.2.2.2.1.4.0.58.152.170.187.204.0", Type: gosnmp.NoSuchInstance},
+			want: &TypeError{OID: ".1.3.6.1.4.1.14179.2.2.2.1.4.0.58.152.170.187.204.0", Type: gosnmp.NoSuchInstance},
+		},
+		{
+			name: "ap index too short",
+			pdu:  gosnmp.SnmpPDU{Name: ".1.3.6.1.4.1.14179.2.2.1.1.3.0.58.152", Type: gosnmp.OctetString, Value: []byte("ap-lobby")},
+			want: &IndexError{OID: ".1.3.6.1.4.1.14179.2.2.1.1.3.0.58.152", Index: "0.58.152", Err: ErrShortIndex},
+		},
+		{
+			name: "unknown column",
+			pdu:  gosnmp.SnmpPDU{Name: ".1.3.6.1.4.1.14179.2.1.4.1.99.0.17.34.51.68.85", Type: gosnmp.Integer, Value: 1},
+			want: &UnknownOIDError{OID: ".1.3.6.1.4.1.14179.2.1.4.1.99.0.17.34.51.68.85", Type: gosnmp.Integer},
+		},
+		{
+			name: "column itself rather than a row",
+			pdu:  gosnmp.SnmpPDU{Name: ".1.3.6.1.4.1.14179.2.1.4.1.4", Type: gosnmp.OctetString, Value: []byte{}},
+			want: &UnknownOIDError{OID: ".1.3.6.1.4.1.14179.2.1.4.1.4", Type: gosnmp.OctetString},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := Decode([]gosnmp.SnmpPDU{tt.pdu})
+			if len(result.Clients) != 0 || len(result.APs) != 0 {
+				t.Errorf("bad PDU was decoded: clients %+v, aps %+v", result.Clients, result.APs)
+			}
+			if len(result.Errors) != 1 || !reflect.DeepEqual(result.Errors[0], tt.want) {
+				t.Errorf("errors: got %v, want [%v]", result.Errors, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeCountsErrors(t *testing.T) {
+	walk := append([]gosnmp.SnmpPDU{
+		{Name: ".1.3.6.1.4.1.14179.2.2.1.1.3.0.58.152.256.187.204", Type: gosnmp.OctetString, Value: []byte("ap-broken")},
+		{Name: ".1.3.6.1.4.1.14179.2.2.2.1.4.0.58", Type: gosnmp.Integer, Value: 1},
+		{Name: ".1.3.6.1.4.1.14179.2.1.6.1.1.0.17.34.51.68.85", Type: gosnmp.Counter32, Value: uint(1)},
+		{Name: ".1.3.6.1.2.1.1.3.0", Type: gosnmp.TimeTicks, Value: uint32(1)},
+	}, capturedWalk...)
+	result := Decode(walk)
+
+	// the bad rows are skipped, and everything else still decodes
+	if len(result.Clients) != 2 || len(result.APs) != 2 {
+		t.Errorf("got %d clients and %d aps, want 2 of each", len(result.Clients), len(result.APs))
+	}
+	want := ErrorCounts{Type: 1, UnknownOID: 1, Index: 2}
+	if got := result.Count(); got != want {
+		t.Errorf("counts: got %+v, want %+v", got, want)
+	}
+	if got := result.Count().Total(); got != 4 {
+		t.Errorf("total: got %d, want 4", got)
+	}
+}
+
+func TestMACIndex(t *testing.T) {
+	tests := []struct {
+		index string
+		want  string
+		err   error
+	}{
+		{index: "0.58.152.170.187.204", want: "003a98aabbcc"},
+		{index: "0.58.152.170.187.204.1", want: "003a98aabbcc"},
+		{index: "255.255.255.255.255.255.99999", want: "ffffffffffff"},
+		{index: "0.58.152.170.187", err: ErrShortIndex},
+		{index: "", err: ErrShortIndex},
+		{index: "0.58.152.170.187.256", err: ErrBadOctet},
+		{index: "0.58.152.170.187.-1", err: ErrBadOctet},
+		{index: "0.58.152.aa.187.204", err: ErrBadOctet},
+		{index: "0.58..170.187.204", err: ErrBadOctet},
+	}
+
+	for _, tt := range tests {
+		got, err := macIndex(tt.index)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("macIndex(%q): got error %v, want %v", tt.index, err, tt.err)
+		}
+		if got != tt.want {
+			t.Errorf("macIndex(%q): got %q, want %q", tt.index, got, tt.want)
+		}
+	}
+}
+
+func TestColumns(t *testing.T) {
+	for i, column := range Columns {
+		switch column.Table {
+		case ClientTable:
+			if column.Client == nil || column.AP != nil {
+				t.Errorf("%s: client column must only set a client", column.OID)
+			}
+		case APTable:
+			if column.AP == nil || column.Client != nil {
+				t.Errorf("%s: ap column must only set an ap", column.OID)
+			}
+		default:
+			t.Errorf("%s: unknown table %v", column.OID, column.Table)
+		}
+		if len(column.Types) == 0 {
+			t.Errorf("%s: no types accepted", column.OID)
+		}
+		if column.Name == "" {
+			t.Errorf("%s: no name", column.OID)
+		}
+
+		// a column inside another would be decoded twice
+		for j, other := range Columns {
+			if i != j && strings.HasPrefix(column.OID+".", other.OID+".") {
+				t.Errorf("%s: overlaps with %s", column.OID, other.OID)
+			}
+			if i != j && column.Name == other.Name {
+				t.Errorf("%s: named %q like %s", column.OID, column.Name, other.OID)
+			}
+		}
+	}
+}
+
+func TestSelect(t *testing.T) {
+	oids, err := Select(nil)
+	if err != nil || !reflect.DeepEqual(oids, OIDs()) {
+		t.Errorf("Select(nil): got %v, %v, want every OID", oids, err)
+	}
+
+	// the order the columns are named in doesn't matter
+	oids, err = Select([]string{"clientmac", "apname"})
+	want := []string{".1.3.6.1.4.1.14179.2.2.1.1.3", ".1.3.6.1.4.1.14179.2.1.4.1.1"}
+	if err != nil || !reflect.DeepEqual(oids, want) {
+		t.Errorf("Select: got %v, %v, want %v", oids, err, want)
+	}
+
+	if _, err := Select([]string{"clientmac", "clientshoesize"}); err == nil || !strings.Contains(err.Error(), "clientshoesize") {
+		t.Errorf("Select with an unknown column: got %v", err)
+	}
+}
@@ -0,0 +1,213 @@
+// Package fakeagent is a small SNMP agent that pretends to be a Cisco AireOS wireless LAN controller, so that
+// wifitracker can be tested end to end without any hardware.
+//
+// It serves the bsnMobileStationEntry, bsnMobileStationStatsEntry, bsnAPEntry and bsnAPIfEntry tables over SNMPv2c
+// on UDP, answering GET, GETNEXT and GETBULK requests, with contents taken from a Scenario.
+package fakeagent
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gosnmp/gosnmp"
+)
+
+// Agent is a running fake controller.
+type Agent struct {
+	community string
+	scenario  *Scenario
+	conn      net.PacketConn
+
+	mu   sync.Mutex
+	step int
+	mib  []gosnmp.SnmpPDU // sorted by OID
+
+	done chan struct{}
+}
+
+// Start listens for SNMP requests on addr, which is usually "127.0.0.1:0", serving the first step of the scenario.
+func Start(addr, community string, scenario *Scenario) (*Agent, error) {
+	if err := scenario.Validate(); err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &Agent{
+		community: community,
+		scenario:  scenario,
+		conn:      conn,
+		done:      make(chan struct{}),
+	}
+	a.load(0)
+	go a.serve()
+	return a, nil
+}
+
+// Addr is the address the agent is listening on.
+func (a *Agent) Addr() *net.UDPAddr {
+	return a.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// Step moves the agent on to the next step of the scenario, returning false if there are no more steps.
+func (a *Agent) Step() bool {
+	a.mu.Lock()
+	step := a.step + 1
+	a.mu.Unlock()
+	if step >= len(a.scenario.Steps) {
+		return false
+	}
+	a.load(step)
+	return true
+}
+
+// Close stops the agent.
+func (a *Agent) Close() error {
+	err := a.conn.Close()
+	<-a.done
+	return err
+}
+
+// load swaps in the contents of the tables at a step.
+func (a *Agent) load(step int) {
+	mib := a.scenario.mib(step)
+	sort.Slice(mib, func(i, j int) bool {
+		return compareOIDs(mib[i].Name, mib[j].Name) < 0
+	})
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.step = step
+	a.mib = mib
+}
+
+// serve answers requests until the agent is closed.
+func (a *Agent) serve() {
+	defer close(a.done)
+
+	// only used for decoding, so never connects to anything
+	decoder := &gosnmp.GoSNMP{Version: gosnmp.Version2c}
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := a.conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+
+		request, err := decoder.SnmpDecodePacket(buf[:n])
+		if err != nil {
+			// garbage, which a real controller would ignore too
+			continue
+		}
+		if request.Version != gosnmp.Version2c || request.Community != a.community {
+			continue
+		}
+
+		response, err := a.respond(request).MarshalMsg()
+		if err != nil {
+			continue
+		}
+		a.conn.WriteTo(response, from)
+	}
+}
+
+// respond works out the answer to a request.
+func (a *Agent) respond(request *gosnmp.SnmpPacket) *gosnmp.SnmpPacket {
+	response := &gosnmp.SnmpPacket{
+		Version:   request.Version,
+		Community: request.Community,
+		PDUType:   gosnmp.GetResponse,
+		RequestID: request.RequestID,
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	switch request.PDUType {
+	case gosnmp.GetRequest:
+		for _, v := range request.Variables {
+			response.Variables = append(response.Variables, a.get(v.Name))
+		}
+	case gosnmp.GetNextRequest:
+		for _, v := range request.Variables {
+			response.Variables = append(response.Variables, a.next(v.Name))
+		}
+	case gosnmp.GetBulkRequest:
+		// the first non-repeaters are answered like GETNEXT, the rest are repeated up to max-repetitions times
+		nonRepeaters := int(request.NonRepeaters)
+		if nonRepeaters > len(request.Variables) {
+			nonRepeaters = len(request.Variables)
+		}
+		for _, v := range request.Variables[:nonRepeaters] {
+			response.Variables = append(response.Variables, a.next(v.Name))
+		}
+		repeaters := request.Variables[nonRepeaters:]
+		for i := 0; i < int(request.MaxRepetitions) && len(repeaters) > 0; i++ {
+			finished := true
+			for j, v := range repeaters {
+				pdu := a.next(v.Name)
+				response.Variables = append(response.Variables, pdu)
+				repeaters[j].Name = pdu.Name
+				if pdu.Type != gosnmp.EndOfMibView {
+					finished = false
+				}
+			}
+			if finished {
+				break
+			}
+		}
+	default:
+		response.Error = gosnmp.GenErr
+		response.Variables = request.Variables
+	}
+
+	return response
+}
+
+// get finds an exact OID.
+func (a *Agent) get(oid string) gosnmp.SnmpPDU {
+	i := sort.Search(len(a.mib), func(i int) bool {
+		return compareOIDs(a.mib[i].Name, oid) >= 0
+	})
+	if i < len(a.mib) && a.mib[i].Name == oid {
+		return a.mib[i]
+	}
+	return gosnmp.SnmpPDU{Name: oid, Type: gosnmp.NoSuchObject}
+}
+
+// next finds the OID following this one.
+func (a *Agent) next(oid string) gosnmp.SnmpPDU {
+	i := sort.Search(len(a.mib), func(i int) bool {
+		return compareOIDs(a.mib[i].Name, oid) > 0
+	})
+	if i < len(a.mib) {
+		return a.mib[i]
+	}
+	return gosnmp.SnmpPDU{Name: oid, Type: gosnmp.EndOfMibView}
+}
+
+// compareOIDs orders OIDs by their sub-identifiers, as numbers rather than text.
+func compareOIDs(a, b string) int {
+	as := strings.Split(strings.TrimPrefix(a, "."), ".")
+	bs := strings.Split(strings.TrimPrefix(b, "."), ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		x, _ := strconv.ParseUint(as[i], 10, 32)
+		y, _ := strconv.ParseUint(bs[i], 10, 32)
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+	}
+	return len(as) - len(bs)
+}
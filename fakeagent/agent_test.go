@@ -0,0 +1,142 @@
+package fakeagent
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/dotwaffle/wifitracker/decoder"
+	"github.com/gosnmp/gosnmp"
+)
+
+// walk polls the agent just like wifitracker does.
+func walk(t *testing.T, a *Agent, community string) (*decoder.Result, error) {
+	t.Helper()
+	session := &gosnmp.GoSNMP{
+		Target:    a.Addr().IP.String(),
+		Port:      uint16(a.Addr().Port),
+		Community: community,
+		Version:   gosnmp.Version2c,
+		Timeout:   time.Second,
+		Retries:   0,
+	}
+	if err := session.Connect(); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	defer session.Conn.Close()
+
+	var pdus []gosnmp.SnmpPDU
+	for _, oid := range decoder.OIDs() {
+		result, err := session.BulkWalkAll(oid)
+		if err != nil {
+			return nil, err
+		}
+		pdus = append(pdus, result...)
+	}
+	result := decoder.Decode(pdus)
+
+	// the decoder orders clients by their dotted index, which isn't the order they're written down in
+	sort.Slice(result.Clients, func(i, j int) bool {
+		return result.Clients[i].MAC < result.Clients[j].MAC
+	})
+	return result, nil
+}
+
+func TestAgentScenario(t *testing.T) {
+	scenario, err := LoadScenario("testdata/roaming.json")
+	if err != nil {
+		t.Fatalf("LoadScenario: %v", err)
+	}
+	a, err := Start("127.0.0.1:0", "public", scenario)
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer a.Close()
+
+	wantAPs := []decoder.AP{
+		{MAC: "003a98aabb01", Name: "ap-lobby", Channel24GHz: 6, Channel5GHz: 36},
+		{MAC: "003a98aabb02", Name: "ap-canteen", Channel24GHz: 11, Channel5GHz: 149},
+	}
+	alice := decoder.Client{APMAC: "003a98aabb01", IP: "192.0.2.10", MAC: "001122334455", SSID: "eduroam", User: "alice", Proto: 6, RSSI: -61, SNR: 32, BytesRecv: 1000, BytesSent: 2000}
+	guest := decoder.Client{APMAC: "003a98aabb01", IP: "192.0.2.11", MAC: "001122334466", SSID: "guest", Proto: 4, RSSI: -70, SNR: 21, BytesRecv: 10, BytesSent: 20}
+	steps := [][]decoder.Client{
+		{alice, guest},
+		{
+			{APMAC: "003a98aabb02", IP: "192.0.2.10", MAC: "001122334455", SSID: "eduroam", User: "alice", Proto: 6, RSSI: -55, SNR: 38, BytesRecv: 5000, BytesSent: 9000},
+			{APMAC: "003a98aabb01", IP: "192.0.2.11", MAC: "001122334466", SSID: "guest", Proto: 4, RSSI: -82, SNR: 9, BytesRecv: 15, BytesSent: 25},
+			{APMAC: "003a98aabb02", IP: "0.0.0.0", MAC: "001122334477", SSID: "eduroam", Proto: 7, RSSI: -48, SNR: 45},
+		},
+		{
+			{APMAC: "003a98aabb02", IP: "192.0.2.10", MAC: "001122334455", SSID: "eduroam", User: "alice", Proto: 6, RSSI: -55, SNR: 38, BytesRecv: 5000, BytesSent: 9000},
+			{APMAC: "003a98aabb02", IP: "0.0.0.0", MAC: "001122334477", SSID: "eduroam", Proto: 7, RSSI: -48, SNR: 45},
+		},
+	}
+
+	for step, wantClients := range steps {
+		if step > 0 && !a.Step() {
+			t.Fatalf("step %d: ran out of steps", step)
+		}
+		result, err := walk(t, a, "public")
+		if err != nil {
+			t.Fatalf("step %d: walk: %v", step, err)
+		}
+		if len(result.Errors) != 0 {
+			t.Errorf("step %d: decoding errors: %v", step, result.Errors)
+		}
+		if !reflect.DeepEqual(result.Clients, wantClients) {
+			t.Errorf("step %d: clients:\n got %+v\nwant %+v", step, result.Clients, wantClients)
+		}
+		if !reflect.DeepEqual(result.APs, wantAPs) {
+			t.Errorf("step %d: aps:\n got %+v\nwant %+v", step, result.APs, wantAPs)
+		}
+	}
+	if a.Step() {
+		t.Errorf("stepped past the end of the scenario")
+	}
+}
+
+func TestAgentIgnoresWrongCommunity(t *testing.T) {
+	a, err := Start("127.0.0.1:0", "public", &Scenario{Steps: []Step{{}}})
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer a.Close()
+
+	if _, err := walk(t, a, "private"); err == nil {
+		t.Errorf("walk with the wrong community did not fail")
+	}
+}
+
+func TestScenarioValidate(t *testing.T) {
+	aps := []AP{{MAC: "00:3a:98:aa:bb:01", Name: "ap-lobby"}}
+	for name, s := range map[string]*Scenario{
+		"no steps":   {APs: aps},
+		"bad ap mac": {APs: []AP{{MAC: "nope", Name: "ap-lobby"}}, Steps: []Step{{}}},
+		"bad client": {APs: aps, Steps: []Step{{Clients: []Client{{MAC: "nope", AP: "ap-lobby"}}}}},
+		"bad ip":     {APs: aps, Steps: []Step{{Clients: []Client{{MAC: "00:11:22:33:44:55", IP: "2001:db8::1", AP: "ap-lobby"}}}}},
+		"missing ap": {APs: aps, Steps: []Step{{Clients: []Client{{MAC: "00:11:22:33:44:55", AP: "ap-roof"}}}}},
+		"bad leaver": {APs: aps, Steps: []Step{{Disconnect: []string{"nope"}}}},
+	} {
+		if err := s.Validate(); err == nil {
+			t.Errorf("%s: Validate did not fail", name)
+		}
+	}
+}
+
+func TestCompareOIDs(t *testing.T) {
+	for _, tt := range []struct {
+		a, b string
+		want int
+	}{
+		{".1.3.6.1.2", ".1.3.6.1.10", -1},
+		{".1.3.6.1.10", ".1.3.6.1.2", 1},
+		{".1.3.6.1", ".1.3.6.1.1", -1},
+		{".1.3.6.1.4", ".1.3.6.1.4", 0},
+	} {
+		got := compareOIDs(tt.a, tt.b)
+		if (got < 0) != (tt.want < 0) || (got > 0) != (tt.want > 0) {
+			t.Errorf("compareOIDs(%q, %q) = %d, want sign of %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package fakeagent
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/gosnmp/gosnmp"
+)
+
+// Scenario describes a controller's APs, and its clients coming and going over a number of steps.
+//
+// Scenarios are written as JSON:
+//
+//	{
+//	  "aps": [
+//	    {"mac": "00:3a:98:aa:bb:cc", "name": "ap-lobby", "channel24": 6, "channel5": 36}
+//	  ],
+//	  "steps": [
+//	    {"clients": [{"mac": "00:11:22:33:44:55", "ip": "192.0.2.10", "ap": "ap-lobby", "ssid": "eduroam", "rssi": -61}]},
+//	    {"clients": [{"mac": "00:11:22:33:44:55", "ip": "192.0.2.10", "ap": "ap-lobby", "ssid": "eduroam", "rssi": -75}]},
+//	    {"disconnect": ["00:11:22:33:44:55"]}
+//	  ]
+//	}
+//
+// Each step starts from the clients of the step before. Clients listed in a step are associated, replacing any
+// previous state of the same client, so a client roams by being listed again with a different AP. Clients listed
+// in disconnect leave.
+type Scenario struct {
+	APs   []AP   `json:"aps"`
+	Steps []Step `json:"steps"`
+}
+
+// AP is an access point joined to the fake controller.
+type AP struct {
+	MAC       string `json:"mac"`
+	Name      string `json:"name"`
+	Channel24 int    `json:"channel24"`
+	Channel5  int    `json:"channel5"`
+}
+
+// Client is a wireless client associated to one of the APs.
+type Client struct {
+	MAC       string `json:"mac"`
+	IP        string `json:"ip"`
+	AP        string `json:"ap"` // the name or MAC of the AP
+	SSID      string `json:"ssid"`
+	User      string `json:"user"`
+	Proto     int    `json:"proto"`
+	RSSI      int    `json:"rssi"`
+	SNR       int    `json:"snr"`
+	BytesRecv uint32 `json:"bytesrecv"`
+	BytesSent uint32 `json:"bytessent"`
+}
+
+// Step is a change in which clients are associated.
+type Step struct {
+	Clients    []Client `json:"clients"`
+	Disconnect []string `json:"disconnect"`
+}
+
+// LoadScenario reads a scenario file.
+func LoadScenario(path string) (*Scenario, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	s := &Scenario{}
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(s); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if err := s.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return s, nil
+}
+
+// Validate checks that every MAC address can be parsed, and every client is on an AP that exists.
+func (s *Scenario) Validate() error {
+	if len(s.Steps) == 0 {
+		return fmt.Errorf("scenario has no steps")
+	}
+	for _, ap := range s.APs {
+		if _, err := net.ParseMAC(ap.MAC); err != nil {
+			return fmt.Errorf("ap %q: %v", ap.Name, err)
+		}
+	}
+	for i, step := range s.Steps {
+		for _, client := range step.Clients {
+			if _, err := net.ParseMAC(client.MAC); err != nil {
+				return fmt.Errorf("step %d: %v", i, err)
+			}
+			if client.IP != "" && net.ParseIP(client.IP).To4() == nil {
+				return fmt.Errorf("step %d: client %s: %q is not an IPv4 address", i, client.MAC, client.IP)
+			}
+			if s.ap(client.AP) == nil {
+				return fmt.Errorf("step %d: client %s: no such ap %q", i, client.MAC, client.AP)
+			}
+		}
+		for _, mac := range step.Disconnect {
+			if _, err := net.ParseMAC(mac); err != nil {
+				return fmt.Errorf("step %d: %v", i, err)
+			}
+		}
+	}
+	return nil
+}
+
+// ap finds an AP by name or MAC.
+func (s *Scenario) ap(nameOrMAC string) *AP {
+	for i, ap := range s.APs {
+		if ap.Name == nameOrMAC || strings.EqualFold(ap.MAC, nameOrMAC) {
+			return &s.APs[i]
+		}
+	}
+	return nil
+}
+
+// Clients works out which clients are associated at a step, ordered by MAC.
+func (s *Scenario) Clients(step int) []Client {
+	associated := make(map[string]Client)
+	for _, change := range s.Steps[:step+1] {
+		for _, client := range change.Clients {
+			associated[normaliseMAC(client.MAC)] = client
+		}
+		for _, mac := range change.Disconnect {
+			delete(associated, normaliseMAC(mac))
+		}
+	}
+
+	clients := make([]Client, 0, len(associated))
+	for _, client := range associated {
+		clients = append(clients, client)
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		return normaliseMAC(clients[i].MAC) < normaliseMAC(clients[j].MAC)
+	})
+	return clients
+}
+
+// the AireOS tables served, as used by wifitracker
+const (
+	bsnMobileStationEntry      = ".1.3.6.1.4.1.14179.2.1.4.1"
+	bsnMobileStationStatsEntry = ".1.3.6.1.4.1.14179.2.1.6.1"
+	bsnAPEntry                 = ".1.3.6.1.4.1.14179.2.2.1.1"
+	bsnAPIfEntry               = ".1.3.6.1.4.1.14179.2.2.2.1"
+	sysObjectID                = ".1.3.6.1.2.1.1.2.0"
+)
+
+// mib builds every object the agent serves at a step, in no particular order.
+func (s *Scenario) mib(step int) []gosnmp.SnmpPDU {
+	pdus := []gosnmp.SnmpPDU{
+		// AIR-CT5508-K9, the most common of the AireOS controllers
+		{Name: sysObjectID, Type: gosnmp.ObjectIdentifier, Value: ".1.3.6.1.4.1.9.1.1069"},
+	}
+
+	for _, ap := range s.APs {
+		mac, _ := net.ParseMAC(ap.MAC)
+		index := dottedIndex(mac)
+		pdus = append(pdus,
+			gosnmp.SnmpPDU{Name: bsnAPEntry + ".1" + index, Type: gosnmp.OctetString, Value: []byte(mac)},
+			gosnmp.SnmpPDU{Name: bsnAPEntry + ".3" + index, Type: gosnmp.OctetString, Value: []byte(ap.Name)},
+			gosnmp.SnmpPDU{Name: bsnAPIfEntry + ".4" + index + ".0", Type: gosnmp.Integer, Value: ap.Channel24},
+			gosnmp.SnmpPDU{Name: bsnAPIfEntry + ".4" + index + ".1", Type: gosnmp.Integer, Value: ap.Channel5},
+		)
+	}
+
+	for _, client := range s.Clients(step) {
+		mac, _ := net.ParseMAC(client.MAC)
+		apMAC, _ := net.ParseMAC(s.ap(client.AP).MAC)
+		index := dottedIndex(mac)
+		ip := client.IP
+		if ip == "" {
+			ip = "0.0.0.0"
+		}
+		pdus = append(pdus,
+			gosnmp.SnmpPDU{Name: bsnMobileStationEntry + ".1" + index, Type: gosnmp.OctetString, Value: []byte(mac)},
+			gosnmp.SnmpPDU{Name: bsnMobileStationEntry + ".2" + index, Type: gosnmp.IPAddress, Value: ip},
+			gosnmp.SnmpPDU{Name: bsnMobileStationEntry + ".3" + index, Type: gosnmp.OctetString, Value: []byte(client.User)},
+			gosnmp.SnmpPDU{Name: bsnMobileStationEntry + ".4" + index, Type: gosnmp.OctetString, Value: []byte(apMAC)},
+			gosnmp.SnmpPDU{Name: bsnMobileStationEntry + ".7" + index, Type: gosnmp.OctetString, Value: []byte(client.SSID)},
+			gosnmp.SnmpPDU{Name: bsnMobileStationEntry + ".25" + index, Type: gosnmp.Integer, Value: client.Proto},
+			gosnmp.SnmpPDU{Name: bsnMobileStationStatsEntry + ".1" + index, Type: gosnmp.Integer, Value: client.RSSI},
+			gosnmp.SnmpPDU{Name: bsnMobileStationStatsEntry + ".2" + index, Type: gosnmp.Counter32, Value: uint(client.BytesRecv)},
+			gosnmp.SnmpPDU{Name: bsnMobileStationStatsEntry + ".3" + index, Type: gosnmp.Counter32, Value: uint(client.BytesSent)},
+			gosnmp.SnmpPDU{Name: bsnMobileStationStatsEntry + ".26" + index, Type: gosnmp.Integer, Value: client.SNR},
+		)
+	}
+
+	return pdus
+}
+
+// dottedIndex turns a MAC address into the dotted decimal table index AireOS uses, with a leading dot.
+func dottedIndex(mac net.HardwareAddr) string {
+	var index string
+	for _, octet := range mac {
+		index += fmt.Sprintf(".%d", octet)
+	}
+	return index
+}
+
+// normaliseMAC makes MAC addresses written in different ways comparable.
+func normaliseMAC(mac string) string {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return mac
+	}
+	return hw.String()
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// readiness keeps track of how each controller and storage backend is getting on, for /readyz.
+type readiness struct {
+	mu          sync.Mutex
+	intervals   int // how many poll intervals a controller can go without a successful poll and still be ready
+	controllers map[string]*controllerStatus
+	backends    map[string]*backendStatus
+}
+
+// controllerStatus is how polling a controller is going.
+type controllerStatus struct {
+	Ready       bool       `json:"ready"`
+	Connected   bool       `json:"connected"`
+	LastSuccess *time.Time `json:"lastSuccess,omitempty"`
+	LastError   string     `json:"lastError,omitempty"`
+
+	interval time.Duration
+}
+
+// backendStatus is how writing to a storage backend is going.
+type backendStatus struct {
+	Ready     bool       `json:"ready"`
+	LastWrite *time.Time `json:"lastWrite,omitempty"`
+	LastError string     `json:"lastError,omitempty"`
+}
+
+// status is how everything is getting on.
+var status = &readiness{
+	controllers: make(map[string]*controllerStatus),
+	backends:    make(map[string]*backendStatus),
+}
+
+// setIntervals sets how many poll intervals a controller can go without a successful poll and still be ready.
+func (r *readiness) setIntervals(intervals int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.intervals = intervals
+}
+
+// watch starts keeping track of a controller, which isn't ready until it's been polled.
+func (r *readiness) watch(name string, interval time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.controllers[name] = &controllerStatus{interval: interval}
+}
+
+// forget stops keeping track of a controller that's no longer polled.
+func (r *readiness) forget(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.controllers, name)
+}
+
+// connected records whether the controller's SNMP session could be opened, or whether it's been closed after the
+// controller stopped answering.
+func (r *readiness) connected(name string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.controllers[name]
+	if !ok {
+		return
+	}
+	s.Connected = err == nil
+	if err != nil {
+		s.LastError = err.Error()
+	}
+}
+
+// polled records how a poll of the controller went.
+func (r *readiness) polled(name string, interval time.Duration, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.controllers[name]
+	if !ok {
+		return
+	}
+	s.interval = interval
+	if err != nil {
+		s.LastError = err.Error()
+		return
+	}
+	now := time.Now()
+	s.LastSuccess = &now
+	s.LastError = ""
+}
+
+// storage starts keeping track of a new set of storage backends, forgetting the old ones.
+func (r *readiness) storage(names []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.backends = make(map[string]*backendStatus, len(names))
+	for _, name := range names {
+		r.backends[name] = &backendStatus{}
+	}
+}
+
+// wrote records how writing a poll to the storage backend went.
+func (r *readiness) wrote(name string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.backends[name]
+	if !ok {
+		return
+	}
+	if err != nil {
+		s.LastError = err.Error()
+		return
+	}
+	now := time.Now()
+	s.LastWrite = &now
+	s.LastError = ""
+}
+
+// readyReport is what /readyz serves.
+type readyReport struct {
+	Ready       bool                         `json:"ready"`
+	Controllers map[string]*controllerStatus `json:"controllers"`
+	Storage     map[string]*backendStatus    `json:"storage"`
+}
+
+// report works out whether everything's ready. A controller is ready while it's connected and has been polled
+// successfully within the last few intervals, and a storage backend is ready unless the last write to it failed.
+// Nothing's ready until there are controllers to poll and storage to write to.
+func (r *readiness) report(now time.Time) *readyReport {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	report := &readyReport{
+		Ready:       len(r.controllers) > 0 && len(r.backends) > 0,
+		Controllers: make(map[string]*controllerStatus, len(r.controllers)),
+		Storage:     make(map[string]*backendStatus, len(r.backends)),
+	}
+	for name, s := range r.controllers {
+		c := *s
+		c.Ready = c.Connected && c.LastSuccess != nil &&
+			now.Sub(*c.LastSuccess) <= time.Duration(r.intervals)*c.interval
+		report.Ready = report.Ready && c.Ready
+		report.Controllers[name] = &c
+	}
+	for name, s := range r.backends {
+		b := *s
+		b.Ready = b.LastError == ""
+		report.Ready = report.Ready && b.Ready
+		report.Storage[name] = &b
+	}
+	return report
+}
+
+// serveHealthz answers as long as the process is alive enough to.
+func serveHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	io.WriteString(w, `{"status":"ok"}`+"\n")
+}
+
+// ServeHTTP says whether every controller is being polled and every storage backend written to, with the detail of
+// each, answering 503 if not.
+func (r *readiness) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	report := r.report(time.Now())
+	w.Header().Set("Content-Type", "application/json")
+	if !report.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(report)
+}
+
+// runHealthcheck is the healthcheck subcommand, which asks the wifitracker serving on -httpaddr whether it's ready,
+// or just alive, printing what it says. It's for the likes of Docker's HEALTHCHECK, where there's no curl to hand.
+//
+//	wifitracker [flags] healthcheck [ready|alive]
+func runHealthcheck(args []string) error {
+	path := "/readyz"
+	switch {
+	case len(args) == 0, len(args) == 1 && args[0] == "ready":
+	case len(args) == 1 && args[0] == "alive":
+		path = "/healthz"
+	default:
+		return fmt.Errorf("usage: wifitracker [flags] healthcheck [ready|alive]")
+	}
+	if *httpAddr == "" {
+		return fmt.Errorf("-httpaddr isn't set, so there's nothing to ask")
+	}
+	host, port, err := net.SplitHostPort(*httpAddr)
+	if err != nil {
+		return err
+	}
+	// listening on every address includes this one
+	if host == "" || net.ParseIP(host).IsUnspecified() {
+		host = "localhost"
+	}
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get("http://" + net.JoinHostPort(host, port) + path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(os.Stdout, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %s", path, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/namsral/flag"
+)
+
+func newReadiness(intervals int) *readiness {
+	r := &readiness{
+		controllers: make(map[string]*controllerStatus),
+		backends:    make(map[string]*backendStatus),
+	}
+	r.setIntervals(intervals)
+	return r
+}
+
+func TestReadiness(t *testing.T) {
+	r := newReadiness(3)
+	now := time.Now()
+	if r.report(now).Ready {
+		t.Errorf("ready with nothing to poll")
+	}
+
+	r.watch("wlc1", 10*time.Second)
+	r.storage([]string{"mysql"})
+	r.connected("wlc1", nil)
+	if report := r.report(now); report.Ready || report.Controllers["wlc1"].Ready || !report.Storage["mysql"].Ready {
+		t.Errorf("got %+v, want wlc1 not ready until it's been polled", report)
+	}
+
+	r.polled("wlc1", 10*time.Second, nil)
+	r.wrote("mysql", nil)
+	if !r.report(time.Now()).Ready {
+		t.Errorf("not ready after a successful poll")
+	}
+	if r.report(time.Now().Add(31 * time.Second)).Ready {
+		t.Errorf("still ready after three intervals without a successful poll")
+	}
+
+	// a failed poll is reported, but it's only the lack of a successful one that matters
+	r.polled("wlc1", 10*time.Second, errors.New("timeout"))
+	report := r.report(time.Now())
+	if !report.Ready || report.Controllers["wlc1"].LastError != "timeout" {
+		t.Errorf("got %+v after one failed poll", report.Controllers["wlc1"])
+	}
+
+	r.wrote("mysql", errors.New("database is down"))
+	if report := r.report(time.Now()); report.Ready || report.Storage["mysql"].Ready {
+		t.Errorf("ready while storage is failing")
+	}
+	r.wrote("mysql", nil)
+
+	r.connected("wlc1", errors.New("no response from controller"))
+	if report := r.report(time.Now()); report.Ready || report.Controllers["wlc1"].Connected {
+		t.Errorf("ready while disconnected")
+	}
+
+	// those no longer polled don't count, and don't come back
+	r.forget("wlc1")
+	r.polled("wlc1", 10*time.Second, nil)
+	if _, ok := r.report(time.Now()).Controllers["wlc1"]; ok {
+		t.Errorf("forgotten controller reported")
+	}
+}
+
+func TestHealthcheck(t *testing.T) {
+	keepFlags(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+	r := newReadiness(3)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", serveHealthz)
+	mux.Handle("/readyz", r)
+	go http.Serve(l, mux)
+
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	flag.Set("httpaddr", "127.0.0.1:"+port)
+	if err := runHealthcheck(nil); err == nil {
+		t.Errorf("ready with nothing to poll")
+	}
+	if err := runHealthcheck([]string{"alive"}); err != nil {
+		t.Errorf("not alive: %v", err)
+	}
+
+	r.watch("wlc1", time.Minute)
+	r.storage([]string{"file"})
+	r.connected("wlc1", nil)
+	r.polled("wlc1", time.Minute, nil)
+	if err := runHealthcheck([]string{"ready"}); err != nil {
+		t.Errorf("not ready: %v", err)
+	}
+
+	for _, args := range [][]string{{"dead"}, {"ready", "alive"}} {
+		if err := runHealthcheck(args); err == nil {
+			t.Errorf("%v: no usage error", args)
+		}
+	}
+	flag.Set("httpaddr", "")
+	if err := runHealthcheck(nil); err == nil {
+		t.Errorf("checked without -httpaddr")
+	}
+}
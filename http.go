@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/dotwaffle/wifitracker/api"
+	"github.com/dotwaffle/wifitracker/store/prometheus"
+)
+
+// exporter is the storage backend serving metrics from every poll, or nil if -httpaddr isn't set.
+var exporter *prometheus.Sink
+
+// apiServer is the storage backend serving the latest poll of each controller as JSON, or nil unless -httpapi is set.
+var apiServer *api.Server
+
+// promOptions are the metrics' settings, from their flags.
+func promOptions() prometheus.Options {
+	return prometheus.Options{
+		ClientBytes: *promClientBytes,
+		ClientLimit: *promClientLimit,
+	}
+}
+
+// serveHTTP listens on addr, serving handler until ctx is done. It only returns an error if it can't listen, so a
+// mistake in the address is noticed straight away.
+func serveHTTP(ctx context.Context, addr string, handler http.Handler) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdown)
+	}()
+	go func() {
+		log.WithFields(log.Fields{
+			"addr": listener.Addr().String(),
+		}).Info("Serving HTTP")
+		if err := server.Serve(listener); err != http.ErrServerClosed {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("HTTP server stopped!")
+		}
+	}()
+	return nil
+}
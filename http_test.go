@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestServeHTTP(t *testing.T) {
+	// find a port nothing's using
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/hello", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	})
+	if err := serveHTTP(ctx, addr, mux); err != nil {
+		t.Fatalf("serveHTTP: %v", err)
+	}
+	if err := serveHTTP(ctx, addr, mux); err == nil {
+		t.Errorf("served twice on %s", addr)
+	}
+
+	resp, err := http.Get("http://" + addr + "/hello")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "hello" {
+		t.Errorf("got %q", body)
+	}
+}
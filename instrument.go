@@ -0,0 +1,64 @@
+package main
+
+import (
+	"time"
+
+	"github.com/dotwaffle/wifitracker/metrics"
+	"github.com/dotwaffle/wifitracker/store"
+)
+
+// registry holds the metrics wifitracker keeps about itself, served alongside the exporter's.
+var registry = &metrics.Registry{}
+
+// the upper bounds of the buckets of how long things took, in seconds
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+var (
+	walkDuration = registry.Histogram("wifitracker_snmp_walk_duration_seconds",
+		"How long walking the OID took.", durationBuckets, "controller", "oid")
+	walkPDUs = registry.Counter("wifitracker_snmp_walk_pdus_total",
+		"PDUs returned by walking the OID.", "controller", "oid")
+	walkFailed = registry.Counter("wifitracker_snmp_walk_failures_total",
+		"Walks of the OID that didn't come back cleanly.", "controller", "oid")
+	decodeErrors = registry.Counter("wifitracker_snmp_decode_errors_total",
+		"PDUs skipped as they couldn't be decoded, by what was wrong with them.", "controller", "type")
+	pollDuration = registry.Histogram("wifitracker_poll_duration_seconds",
+		"How long polls took, from walking the controller to writing to storage.", durationBuckets, "controller")
+	pollFailures = registry.Counter("wifitracker_poll_failures_total",
+		"Polls that failed.", "controller")
+	pollsSkipped = registry.Counter("wifitracker_polls_skipped_total",
+		"Polls skipped, as they fell due while others were still running.", "controller")
+	pollsLate = registry.Counter("wifitracker_polls_late_total",
+		"Polls run late, as the one before overran.", "controller")
+	pollLastSuccess = registry.Gauge("wifitracker_last_success_timestamp_seconds",
+		"When a poll of the controller last made it all the way to storage.", "controller")
+	storageWriteDuration = registry.Histogram("wifitracker_storage_write_duration_seconds",
+		"How long writing a poll to the storage backend took.", durationBuckets, "backend")
+	storageRows = registry.Counter("wifitracker_storage_rows_total",
+		"Rows written to the storage backend.", "backend")
+	storageFailures = registry.Counter("wifitracker_storage_write_failures_total",
+		"Writes to the storage backend that failed, such as a commit that didn't go through.", "backend")
+)
+
+// instrumentedSink keeps metrics of how writing to a storage backend goes.
+type instrumentedSink struct {
+	name string
+	sink store.Sink
+}
+
+func (s *instrumentedSink) Write(snapshot *store.Snapshot) error {
+	timeStartWrite := time.Now()
+	err := s.sink.Write(snapshot)
+	status.wrote(s.name, err)
+	if err != nil {
+		storageFailures.Inc(s.name)
+		return err
+	}
+	storageWriteDuration.Observe(time.Since(timeStartWrite).Seconds(), s.name)
+	storageRows.Add(float64(snapshot.Rows()), s.name)
+	return nil
+}
+
+func (s *instrumentedSink) Close() error {
+	return s.sink.Close()
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dotwaffle/wifitracker/decoder"
+	"github.com/dotwaffle/wifitracker/metrics"
+	"github.com/dotwaffle/wifitracker/store"
+)
+
+// scrapeRegistry returns the samples served from the registry, by their name and labels.
+func scrapeRegistry(t *testing.T) map[string]string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	metrics.Handler(registry).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	samples := make(map[string]string)
+	for _, line := range strings.Split(rec.Body.String(), "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndex(line, " ")
+		samples[line[:i]] = line[i+1:]
+	}
+	return samples
+}
+
+func TestInstrumentedSink(t *testing.T) {
+	snapshot := &store.Snapshot{
+		Clients: make([]decoder.Client, 3),
+		APs:     make([]decoder.AP, 2),
+	}
+	working := &instrumentedSink{name: "test-working", sink: &slowSink{}}
+	broken := &instrumentedSink{name: "test-broken", sink: &brokenSink{}}
+	for i := 0; i < 2; i++ {
+		if err := working.Write(snapshot); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		if err := broken.Write(snapshot); err == nil {
+			t.Fatalf("Write to broken sink succeeded")
+		}
+	}
+
+	samples := scrapeRegistry(t)
+	for sample, want := range map[string]string{
+		`wifitracker_storage_rows_total{backend="test-working"}`:                              "10",
+		`wifitracker_storage_write_duration_seconds_count{backend="test-working"}`:            "2",
+		`wifitracker_storage_write_failures_total{backend="test-broken"}`:                     "2",
+		`wifitracker_storage_write_duration_seconds_bucket{backend="test-working",le="+Inf"}`: "2",
+	} {
+		if samples[sample] != want {
+			t.Errorf("%s: got %q, want %q", sample, samples[sample], want)
+		}
+	}
+	if _, ok := samples[`wifitracker_storage_rows_total{backend="test-broken"}`]; ok {
+		t.Errorf("rows counted for failed writes")
+	}
+}
+
+func TestCollectorMetrics(t *testing.T) {
+	sink := &slowSink{delay: 50 * time.Millisecond}
+	c := runUntil(t, scheduleSkip, 20*time.Millisecond, sink, 3)
+
+	samples := scrapeRegistry(t)
+	controller := `controller="` + c.name + `"`
+	oid := `oid="` + decoder.OIDs()[0] + `"`
+	for _, sample := range []string{
+		`wifitracker_snmp_walk_pdus_total{` + controller + `,` + oid + `}`,
+		`wifitracker_snmp_walk_duration_seconds_count{` + controller + `,` + oid + `}`,
+		`wifitracker_poll_duration_seconds_count{` + controller + `}`,
+		`wifitracker_polls_skipped_total{` + controller + `}`,
+		`wifitracker_last_success_timestamp_seconds{` + controller + `}`,
+	} {
+		if !regexp.MustCompile(`^[1-9]`).MatchString(samples[sample]) {
+			t.Errorf("%s: got %q, want more than nothing", sample, samples[sample])
+		}
+	}
+	if got := samples[`wifitracker_snmp_decode_errors_total{`+controller+`,type="unknownoid"}`]; got != "0" {
+		t.Errorf("got %q unknown OIDs, want 0", got)
+	}
+
+	// a controller that's gone stops being served
+	registry.Delete("controller", c.name)
+	for sample := range scrapeRegistry(t) {
+		if strings.Contains(sample, controller) {
+			t.Errorf("%s still served", sample)
+		}
+	}
+}
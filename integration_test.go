@@ -0,0 +1,176 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dotwaffle/wifitracker/fakeagent"
+	"github.com/dotwaffle/wifitracker/store"
+	"github.com/dotwaffle/wifitracker/store/mysql"
+	"github.com/dotwaffle/wifitracker/store/sqlite"
+)
+
+// the MySQL integration tests need a database they can create tables in, such as
+// WIFITRACKER_TEST_MYSQL_DSN="user:pass@tcp(localhost:3306)/wifitest"
+const testDSNEnv = "WIFITRACKER_TEST_MYSQL_DSN"
+
+// how each database's addresses are read back as the text the decoder produced
+const (
+	mysqlAddresses  = "LOWER(HEX(apmac)), INET6_NTOA(clientip), LOWER(HEX(clientmac))"
+	sqliteAddresses = "apmac, clientip, clientmac"
+)
+
+// testMySQL opens the test database as storage, and separately for checking what was written, skipping the test if
+// there isn't one.
+func testMySQL(t *testing.T) (store.Sink, *sql.DB) {
+	t.Helper()
+	dsn := os.Getenv(testDSNEnv)
+	if dsn == "" {
+		t.Skipf("%s not set, skipping integration test", testDSNEnv)
+	}
+	sink, err := mysql.Open(dsn, mysql.Options{AutoMigrate: true})
+	if err != nil {
+		t.Fatalf("mysql.Open: %v", err)
+	}
+	t.Cleanup(func() { sink.Close() })
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return sink, db
+}
+
+// testSQLite opens a fresh SQLite database, which needs nothing set up beforehand.
+func testSQLite(t *testing.T) (store.Sink, *sql.DB) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "wifitracker.db")
+	sink, err := sqlite.Open(path, true)
+	if err != nil {
+		t.Fatalf("sqlite.Open: %v", err)
+	}
+	t.Cleanup(func() { sink.Close() })
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return sink, db
+}
+
+// testController connects a controller with a unique name to the fake agent, so its rows can be told apart.
+func testController(t *testing.T, agent *fakeagent.Agent) *controller {
+	t.Helper()
+	c := newController(fmt.Sprintf("test-%d", time.Now().UnixNano()), agent.Addr().IP.String())
+	c.port = uint16(agent.Addr().Port)
+	c.version = "2c"
+	c.community = "public"
+	c.retries = 0
+	if err := c.connect(); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	t.Cleanup(func() { c.close() })
+	return c
+}
+
+// clientRow is the part of a clients row worth comparing.
+type clientRow struct {
+	APMAC, IP, MAC, SSID, User string
+	Proto, RSSI, SNR           int
+	Recv, Sent                 int
+}
+
+// clientRows fetches the rows the controller has written since lastID, returning them along with the new last ID.
+// addresses selects the apmac, clientip and clientmac columns as text.
+func clientRows(t *testing.T, db *sql.DB, addresses string, c *controller, lastID int64) ([]clientRow, int64) {
+	t.Helper()
+	rows, err := db.Query(`
+		SELECT id, `+addresses+`, clientssid, clientuser, clientproto, clientrssi, clientsnr, clientrecv, clientsent
+		FROM clients WHERE controller = ? AND id > ? ORDER BY clientmac`,
+		c.name, lastID)
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	defer rows.Close()
+
+	var found []clientRow
+	for rows.Next() {
+		var id int64
+		var r clientRow
+		if err := rows.Scan(&id, &r.APMAC, &r.IP, &r.MAC, &r.SSID, &r.User, &r.Proto, &r.RSSI, &r.SNR, &r.Recv, &r.Sent); err != nil {
+			t.Fatalf("Scan: %v", err)
+		}
+		if id > lastID {
+			lastID = id
+		}
+		found = append(found, r)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatalf("rows: %v", err)
+	}
+	return found, lastID
+}
+
+func TestPollFakeControllerMySQL(t *testing.T) {
+	sink, db := testMySQL(t)
+	testPollFakeController(t, sink, db, mysqlAddresses)
+}
+
+func TestPollFakeControllerSQLite(t *testing.T) {
+	sink, db := testSQLite(t)
+	testPollFakeController(t, sink, db, sqliteAddresses)
+}
+
+// testPollFakeController plays the roaming scenario, checking what each poll writes to the database.
+func testPollFakeController(t *testing.T, sink store.Sink, db *sql.DB, addresses string) {
+	scenario, err := fakeagent.LoadScenario("fakeagent/testdata/roaming.json")
+	if err != nil {
+		t.Fatalf("LoadScenario: %v", err)
+	}
+	agent, err := fakeagent.Start("127.0.0.1:0", "public", scenario)
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer agent.Close()
+	c := testController(t, agent)
+
+	alice := clientRow{"003a98aabb01", "192.0.2.10", "001122334455", "eduroam", "alice", 6, -61, 32, 1000, 2000}
+	guest := clientRow{"003a98aabb01", "192.0.2.11", "001122334466", "guest", "", 4, -70, 21, 10, 20}
+	roamed := clientRow{"003a98aabb02", "192.0.2.10", "001122334455", "eduroam", "alice", 6, -55, 38, 5000, 9000}
+	fading := clientRow{"003a98aabb01", "192.0.2.11", "001122334466", "guest", "", 4, -82, 9, 15, 25}
+	joined := clientRow{"003a98aabb02", "0.0.0.0", "001122334477", "eduroam", "", 7, -48, 45, 0, 0}
+	want := [][]clientRow{
+		{alice, guest},
+		{roamed, fading, joined},
+		{roamed, joined},
+	}
+
+	// polls can land in the same second, so tell them apart by the rows written since the last one
+	var lastID int64
+	for i := range want {
+		if i > 0 && !agent.Step() {
+			t.Fatalf("poll %d: ran out of steps", i)
+		}
+		if err := c.poll(sink, i+1, time.Now()); err != nil {
+			t.Fatalf("poll %d: %v", i, err)
+		}
+		var got []clientRow
+		got, lastID = clientRows(t, db, addresses, c, lastID)
+		if !reflect.DeepEqual(got, want[i]) {
+			t.Errorf("poll %d: clients:\n got %+v\nwant %+v", i, got, want[i])
+		}
+	}
+
+	var aps int
+	if err := db.QueryRow("SELECT COUNT(*) FROM aps WHERE controller = ?", c.name).Scan(&aps); err != nil {
+		t.Fatalf("QueryRow: %v", err)
+	}
+	if aps != 2*len(want) {
+		t.Errorf("got %d ap rows, want %d", aps, 2*len(want))
+	}
+}
@@ -0,0 +1,164 @@
+package metrics
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Registry keeps a set of metrics, each with any number of series told apart by their labels.
+type Registry struct {
+	mu       sync.Mutex
+	families []*family
+}
+
+// family is a metric, and every series of it.
+type family struct {
+	name, kind, help string
+	labels           []string
+	buckets          []float64 // for histograms
+	series           map[string]*series
+}
+
+// series is a metric with a single set of label values.
+type series struct {
+	values    []string
+	value     float64
+	histogram *Histogram
+}
+
+func (r *Registry) add(name, kind, help string, buckets []float64, labels []string) *family {
+	f := &family{
+		name:    name,
+		kind:    kind,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*series),
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.families = append(r.families, f)
+	return f
+}
+
+// get returns the series with the given label values, starting it if it's new. The registry must be locked.
+func (f *family) get(values []string) *series {
+	if len(values) != len(f.labels) {
+		panic("metrics: " + f.name + " wants labels " + strings.Join(f.labels, ", "))
+	}
+	key := strings.Join(values, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{values: append([]string(nil), values...)}
+		if f.kind == "histogram" {
+			s.histogram = NewHistogram(f.buckets)
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+// CounterVec is a count of something that only goes up.
+type CounterVec struct {
+	r *Registry
+	f *family
+}
+
+// Counter adds a counter, labelled with the given label names.
+func (r *Registry) Counter(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{r: r, f: r.add(name, "counter", help, nil, labels)}
+}
+
+// Add adds to the count with the given label values.
+func (c *CounterVec) Add(v float64, values ...string) {
+	c.r.mu.Lock()
+	defer c.r.mu.Unlock()
+	c.f.get(values).value += v
+}
+
+// Inc adds one to the count with the given label values.
+func (c *CounterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// GaugeVec is a measurement of something that goes up and down.
+type GaugeVec struct {
+	r *Registry
+	f *family
+}
+
+// Gauge adds a gauge, labelled with the given label names.
+func (r *Registry) Gauge(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{r: r, f: r.add(name, "gauge", help, nil, labels)}
+}
+
+// Set sets the gauge with the given label values.
+func (g *GaugeVec) Set(v float64, values ...string) {
+	g.r.mu.Lock()
+	defer g.r.mu.Unlock()
+	g.f.get(values).value = v
+}
+
+// HistogramVec is a tally of values, such as how long things took.
+type HistogramVec struct {
+	r *Registry
+	f *family
+}
+
+// Histogram adds a histogram with the given buckets' upper bounds, in ascending order, labelled with the given label
+// names.
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return &HistogramVec{r: r, f: r.add(name, "histogram", help, buckets, labels)}
+}
+
+// Observe counts a value into the histogram with the given label values.
+func (h *HistogramVec) Observe(v float64, values ...string) {
+	h.r.mu.Lock()
+	defer h.r.mu.Unlock()
+	h.f.get(values).histogram.Observe(v)
+}
+
+// Delete removes every series with the given label value, such as those of a controller that's no longer polled.
+func (r *Registry) Delete(label, value string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, f := range r.families {
+		for i, name := range f.labels {
+			if name != label {
+				continue
+			}
+			for key, s := range f.series {
+				if s.values[i] == value {
+					delete(f.series, key)
+				}
+			}
+		}
+	}
+}
+
+// WriteMetrics writes out every metric, in the order they were added, with their series in order of their labels.
+func (r *Registry) WriteMetrics(w *Writer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, f := range r.families {
+		w.Family(f.name, f.kind, f.help)
+		keys := make([]string, 0, len(f.series))
+		for key := range f.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			s := f.series[key]
+			labels := make([]Label, len(f.labels))
+			for i, name := range f.labels {
+				labels[i] = Label{name, s.values[i]}
+			}
+			if s.histogram != nil {
+				w.Histogram(f.name, labels, s.histogram)
+				continue
+			}
+			w.Sample(f.name, labels, s.value)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	r := &Registry{}
+	polls := r.Counter("polls_total", "Polls.", "controller")
+	temperature := r.Gauge("temperature_celsius", "How hot it is.")
+	duration := r.Histogram("duration_seconds", "How long it took.", []float64{0.1, 1}, "controller", "oid")
+
+	polls.Inc("wlc2")
+	polls.Add(2, "wlc1")
+	polls.Inc("wlc1")
+	temperature.Set(21.5)
+	duration.Observe(0.05, "wlc1", "1.2.3")
+	duration.Observe(0.5, "wlc1", "1.2.3")
+	duration.Observe(5, "wlc1", "1.2.3")
+
+	rec := httptest.NewRecorder()
+	Handler(r).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != ContentType {
+		t.Errorf("Content-Type %q", ct)
+	}
+	want := `# HELP polls_total Polls.
+# TYPE polls_total counter
+polls_total{controller="wlc1"} 3
+polls_total{controller="wlc2"} 1
+# HELP temperature_celsius How hot it is.
+# TYPE temperature_celsius gauge
+temperature_celsius 21.5
+# HELP duration_seconds How long it took.
+# TYPE duration_seconds histogram
+duration_seconds_bucket{controller="wlc1",oid="1.2.3",le="0.1"} 1
+duration_seconds_bucket{controller="wlc1",oid="1.2.3",le="1"} 2
+duration_seconds_bucket{controller="wlc1",oid="1.2.3",le="+Inf"} 3
+duration_seconds_sum{controller="wlc1",oid="1.2.3"} 5.55
+duration_seconds_count{controller="wlc1",oid="1.2.3"} 3
+`
+	if rec.Body.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", rec.Body.String(), want)
+	}
+
+	r.Delete("controller", "wlc1")
+	rec = httptest.NewRecorder()
+	Handler(r).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if strings.Contains(rec.Body.String(), "wlc1") || !strings.Contains(rec.Body.String(), "wlc2") {
+		t.Errorf("after deleting wlc1, got:\n%s", rec.Body.String())
+	}
+}
+
+func TestLabelEscaping(t *testing.T) {
+	var b strings.Builder
+	w := NewWriter(&b)
+	w.Sample("ap_clients", []Label{{Name: "ap", Value: "lobby \"east\"\\\n"}}, 2)
+	w.Flush()
+	if want := `ap_clients{ap="lobby \"east\"\\\n"} 2` + "\n"; b.String() != want {
+		t.Errorf("got %q, want %q", b.String(), want)
+	}
+}
@@ -0,0 +1,132 @@
+// Package metrics writes metrics in the Prometheus text exposition format, and keeps the counters, gauges and
+// histograms wifitracker keeps about itself.
+//
+// A Registry holds metrics that are updated as things happen, such as how long each walk took. Anything else with
+// metrics to serve, such as those worked out from the latest poll, can write them itself as a Source, and a single
+// Handler serves them all.
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ContentType is the version of the text exposition format that's written.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Label is a metric label, and its value.
+type Label struct {
+	Name, Value string
+}
+
+// Writer writes metrics out in the Prometheus text exposition format.
+type Writer struct {
+	w *bufio.Writer
+}
+
+// NewWriter returns a writer of metrics to w, which needs flushing once they're all written.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: bufio.NewWriter(w)}
+}
+
+// Family starts a metric family, which every sample of it has to follow.
+func (w *Writer) Family(name, kind, help string) {
+	w.w.WriteString("# HELP " + name + " " + help + "\n")
+	w.w.WriteString("# TYPE " + name + " " + kind + "\n")
+}
+
+// Sample writes a single sample.
+func (w *Writer) Sample(name string, labels []Label, value float64) {
+	w.w.WriteString(name)
+	if len(labels) > 0 {
+		w.w.WriteByte('{')
+		for i, l := range labels {
+			if i > 0 {
+				w.w.WriteByte(',')
+			}
+			w.w.WriteString(l.Name + `="` + labelEscaper.Replace(l.Value) + `"`)
+		}
+		w.w.WriteByte('}')
+	}
+	w.w.WriteByte(' ')
+	w.w.WriteString(formatValue(value))
+	w.w.WriteByte('\n')
+}
+
+// Histogram writes the samples of a histogram.
+func (w *Writer) Histogram(name string, labels []Label, h *Histogram) {
+	var cumulative uint64
+	for i, le := range h.buckets {
+		cumulative += h.counts[i]
+		w.Sample(name+"_bucket", append(labels[:len(labels):len(labels)], Label{"le", formatValue(le)}), float64(cumulative))
+	}
+	w.Sample(name+"_bucket", append(labels[:len(labels):len(labels)], Label{"le", "+Inf"}), float64(h.count))
+	w.Sample(name+"_sum", labels, h.sum)
+	w.Sample(name+"_count", labels, float64(h.count))
+}
+
+// Flush writes out anything still buffered.
+func (w *Writer) Flush() error {
+	return w.w.Flush()
+}
+
+// Histogram is a tally of values, counted into buckets.
+type Histogram struct {
+	buckets []float64
+	counts  []uint64 // of the values in each bucket but not the one before
+	sum     float64
+	count   uint64
+}
+
+// NewHistogram returns an empty histogram, given its buckets' upper bounds in ascending order.
+func NewHistogram(buckets []float64) *Histogram {
+	return &Histogram{
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+}
+
+// Observe counts a value.
+func (h *Histogram) Observe(v float64) {
+	for i, le := range h.buckets {
+		if v <= le {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// Source is something with metrics to serve.
+type Source interface {
+	WriteMetrics(w *Writer)
+}
+
+// Handler serves the metrics of every source, one after the other.
+func Handler(sources ...Source) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", ContentType)
+		w := NewWriter(rw)
+		for _, source := range sources {
+			source.WriteMetrics(w)
+		}
+		w.Flush()
+	})
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/dotwaffle/wifitracker/store/migrate"
+)
+
+// runMigrate is the migrate subcommand, which shows or updates the schema of every storage backend configured.
+//
+//	wifitracker [flags] migrate [status|up]
+func runMigrate(args []string) error {
+	action := "status"
+	if len(args) > 0 {
+		action = args[0]
+	}
+	if len(args) > 1 || (action != "status" && action != "up") {
+		return fmt.Errorf("usage: wifitracker [flags] migrate [status|up]")
+	}
+
+	backends, err := storageBackends(*storage)
+	if err != nil {
+		return err
+	}
+	for _, name := range backends {
+		migrator, db, err := openMigrator(name)
+		if err != nil {
+			return fmt.Errorf("storage %q: %v", name, err)
+		}
+		if migrator == nil {
+			fmt.Printf("%s: no schema to migrate\n", name)
+			continue
+		}
+
+		if action == "up" {
+			applied, err := migrator.Up()
+			if err != nil {
+				db.Close()
+				return fmt.Errorf("storage %q: %v", name, err)
+			}
+			fmt.Printf("%s: applied %d migrations\n", name, len(applied))
+		}
+		err = printMigrations(name, migrator)
+		db.Close()
+		if err != nil {
+			return fmt.Errorf("storage %q: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// printMigrations shows which migrations have been applied, and which haven't.
+func printMigrations(name string, migrator *migrate.Migrator) error {
+	version, err := migrator.Version()
+	if err != nil {
+		return err
+	}
+	statuses, err := migrator.Status()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s: schema version %d, wifitracker knows up to %d\n", name, version, migrator.Latest())
+	if version > migrator.Latest() {
+		fmt.Printf("%s: the database is newer than this wifitracker, upgrade it before running against this database\n", name)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, status := range statuses {
+		applied := "pending"
+		if !status.Applied.IsZero() {
+			applied = "applied " + status.Applied.Format("2006-01-02 15:04:05 MST")
+		}
+		fmt.Fprintf(w, "  %04d\t%s\t%s\n", status.Version, status.Name, applied)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+
+	"github.com/dotwaffle/wifitracker/decoder"
+)
+
+// privacy is what's done to each client before it's stored, so the people carrying them can't be picked out from
+// what's kept.
+type privacy struct {
+	hashMACs   bool   // store a keyed hash of each client's MAC address in its place
+	key        string // the key for hashing MAC addresses
+	dropUsers  bool   // store no usernames
+	ipv4Prefix int    // how many bits of each client's IPv4 address are kept, the rest being zeroed
+	ipv6Prefix int    // likewise for IPv6
+}
+
+// configuredPrivacy returns the privacy settings from the flags.
+func configuredPrivacy() privacy {
+	return privacy{
+		hashMACs:   *privacyHashMACs,
+		key:        *privacyKey,
+		dropUsers:  *privacyDropUsers,
+		ipv4Prefix: *privacyIPv4Prefix,
+		ipv6Prefix: *privacyIPv6Prefix,
+	}
+}
+
+// check makes sure the privacy settings make sense.
+func (p privacy) check() error {
+	if p.hashMACs && p.key == "" {
+		return fmt.Errorf("-privacyhashmacs needs -privacykey")
+	}
+	if p.ipv4Prefix < 0 || p.ipv4Prefix > 8*net.IPv4len {
+		return fmt.Errorf("-privacyipv4prefix must be between 0 and %d", 8*net.IPv4len)
+	}
+	if p.ipv6Prefix < 0 || p.ipv6Prefix > 8*net.IPv6len {
+		return fmt.Errorf("-privacyipv6prefix must be between 0 and %d", 8*net.IPv6len)
+	}
+	return nil
+}
+
+// apply makes the clients as private as the settings say.
+func (p privacy) apply(clients []decoder.Client) {
+	for i := range clients {
+		client := &clients[i]
+		if p.hashMACs && client.MAC != "" {
+			client.MAC = p.hashMAC(client.MAC)
+		}
+		if p.dropUsers {
+			client.User = ""
+		}
+		client.IP = p.maskIP(client.IP)
+	}
+}
+
+// hashMAC turns a MAC address into another, the first six bytes of its HMAC-SHA256 under the key, so the same client
+// always gets the same address without anyone lacking the key being able to work out the real one. It's marked as
+// locally administered, as it's not a real address, and unicast, as the client's was.
+func (p privacy) hashMAC(mac string) string {
+	h := hmac.New(sha256.New, []byte(p.key))
+	h.Write([]byte(mac))
+	hashed := h.Sum(nil)[:6]
+	hashed[0] = hashed[0]&^0x01 | 0x02
+	return hex.EncodeToString(hashed)
+}
+
+// maskIP zeroes all but the leading bits of an IP address the settings keep, leaving anything that isn't an IP
+// address alone.
+func (p privacy) maskIP(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ip
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		if p.ipv4Prefix == 8*net.IPv4len {
+			return ip
+		}
+		return v4.Mask(net.CIDRMask(p.ipv4Prefix, 8*net.IPv4len)).String()
+	}
+	if p.ipv6Prefix == 8*net.IPv6len {
+		return ip
+	}
+	return parsed.Mask(net.CIDRMask(p.ipv6Prefix, 8*net.IPv6len)).String()
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/dotwaffle/wifitracker/decoder"
+)
+
+func TestPrivacy(t *testing.T) {
+	clients := []decoder.Client{
+		{MAC: "001122334455", IP: "192.0.2.77", User: "alice", SSID: "staff"},
+		{MAC: "001122334455", IP: "2001:db8:1:2:3:4:5:6", User: "alice"},
+		{MAC: "66778899aabb", IP: "0.0.0.0"},
+		{IP: "not an address"},
+	}
+	p := privacy{hashMACs: true, key: "pepper", dropUsers: true, ipv4Prefix: 24, ipv6Prefix: 48}
+	p.apply(clients)
+
+	for i, want := range []string{"192.0.2.0", "2001:db8:1::", "0.0.0.0", "not an address"} {
+		if clients[i].IP != want {
+			t.Errorf("client %d: got IP %q, want %q", i, clients[i].IP, want)
+		}
+		if clients[i].User != "" {
+			t.Errorf("client %d: username %q kept", i, clients[i].User)
+		}
+	}
+	if clients[0].SSID != "staff" {
+		t.Errorf("SSID changed to %q", clients[0].SSID)
+	}
+
+	// the same client always gets the same address, which is locally administered and unicast, and still a MAC address
+	if clients[0].MAC == "001122334455" || clients[0].MAC != clients[1].MAC || clients[0].MAC == clients[2].MAC {
+		t.Errorf("got MACs %q, %q and %q", clients[0].MAC, clients[1].MAC, clients[2].MAC)
+	}
+	b, err := hex.DecodeString(clients[0].MAC)
+	if err != nil || len(b) != 6 || b[0]&0x03 != 0x02 {
+		t.Errorf("hashed MAC %q isn't a locally administered unicast address", clients[0].MAC)
+	}
+	if clients[3].MAC != "" {
+		t.Errorf("missing MAC hashed to %q", clients[3].MAC)
+	}
+
+	// and a different key gives a different address
+	other := []decoder.Client{{MAC: "001122334455"}}
+	privacy{hashMACs: true, key: "salt", ipv4Prefix: 32, ipv6Prefix: 128}.apply(other)
+	if other[0].MAC == clients[0].MAC {
+		t.Errorf("different keys hashed to the same MAC %q", other[0].MAC)
+	}
+
+	// by default, nothing changes
+	kept := []decoder.Client{{MAC: "001122334455", IP: "192.0.2.77", User: "alice"}}
+	privacy{ipv4Prefix: 32, ipv6Prefix: 128}.apply(kept)
+	if kept[0] != (decoder.Client{MAC: "001122334455", IP: "192.0.2.77", User: "alice"}) {
+		t.Errorf("default privacy changed the client to %+v", kept[0])
+	}
+}
+
+func TestPrivacyCheck(t *testing.T) {
+	for _, p := range []privacy{
+		{hashMACs: true, ipv4Prefix: 32, ipv6Prefix: 128},
+		{ipv4Prefix: 33, ipv6Prefix: 128},
+		{ipv4Prefix: -1, ipv6Prefix: 128},
+		{ipv4Prefix: 32, ipv6Prefix: 129},
+	} {
+		if err := p.check(); err == nil {
+			t.Errorf("%+v allowed", p)
+		}
+	}
+	if err := (privacy{hashMACs: true, key: "pepper", ipv4Prefix: 0, ipv6Prefix: 64}).check(); err != nil {
+		t.Errorf("check: %v", err)
+	}
+}
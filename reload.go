@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/namsral/flag"
+)
+
+// settings which only take effect at startup, so changing them means restarting
+var restartOnly = map[string]bool{
+	"config":      true,
+	"configtoml":  true,
+	"configwatch": true,
+	"httpaddr":    true,
+	"httpapi":     true,
+	"snmprecord":  true,
+	"snmpreplay":  true,
+}
+
+// settings which mean opening storage again when they change
+var storageSettings = map[string]bool{
+	"automigrate":     true,
+	"filelog":         true,
+	"pgchunkinterval": true,
+	"pgcompressafter": true,
+	"pgdsn":           true,
+	"pgtimescale":     true,
+	"spooldir":        true,
+	"spoolmaxage":     true,
+	"spoolmaxmb":      true,
+	"sqlbatchsize":    true,
+	"sqldb":           true,
+	"sqldsn":          true,
+	"sqlhost":         true,
+	"sqlitepath":      true,
+	"sqlpass":         true,
+	"sqlport":         true,
+	"sqltls":          true,
+	"sqluser":         true,
+	"storage":         true,
+}
+
+// settings which are never logged, as they are or may contain passwords
+var secretSettings = map[string]bool{
+	"pgdsn":           true,
+	"privacykey":      true,
+	"snmpcommunity":   true,
+	"snmpcontrollers": true,
+	"snmpv3authpass":  true,
+	"snmpv3privpass":  true,
+	"sqldsn":          true,
+	"sqlpass":         true,
+}
+
+// configValue is a setting as read from the configuration, checked to suit the flag it's for and written the way the
+// flag would write it, so it can be compared with the flag's value.
+type configValue struct {
+	text string
+	kind interface{} // the flag's value, for its type
+}
+
+func (v *configValue) Set(s string) error {
+	switch v.kind.(type) {
+	case bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		s = strconv.FormatBool(b)
+	case int:
+		i, err := strconv.ParseInt(s, 0, strconv.IntSize)
+		if err != nil {
+			return err
+		}
+		s = strconv.FormatInt(i, 10)
+	case int64:
+		i, err := strconv.ParseInt(s, 0, 64)
+		if err != nil {
+			return err
+		}
+		s = strconv.FormatInt(i, 10)
+	case float64:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		s = strconv.FormatFloat(f, 'g', -1, 64)
+	case time.Duration:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		s = d.String()
+	}
+	v.text = s
+	return nil
+}
+
+func (v *configValue) String() string {
+	return v.text
+}
+
+func (v *configValue) IsBoolFlag() bool {
+	_, ok := v.kind.(bool)
+	return ok
+}
+
+// readConfig reads the configuration again from args, the environment and the config files, the same way flag.Parse,
+// applyConfigFile and applyTOMLConfig did at startup, returning every setting as it would be written by its flag, and
+// the controllers in the TOML config file.
+func readConfig(args []string) (map[string]string, []controllerConfig, error) {
+	fs := flag.NewFlagSetWithEnvPrefix(os.Args[0], flag.EnvironmentPrefix, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	values := make(map[string]*configValue)
+	flag.VisitAll(func(f *flag.Flag) {
+		v := &configValue{text: f.DefValue}
+		if getter, ok := f.Value.(flag.Getter); ok {
+			v.kind = getter.Get()
+		}
+		values[f.Name] = v
+		fs.Var(v, f.Name, f.Usage)
+	})
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+	if err := applyConfigFile(fs); err != nil {
+		return nil, nil, err
+	}
+	controllers, err := applyTOMLConfig(fs)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := readSecretFiles(fs); err != nil {
+		return nil, nil, err
+	}
+
+	config := make(map[string]string, len(values))
+	for name, v := range values {
+		config[name] = v.text
+	}
+	return config, controllers, nil
+}
+
+// change is a setting that's different in the configuration to how it's set now.
+type change struct {
+	name, old, new string
+}
+
+// diffConfig returns the settings in config that differ from how they're set now, in name order.
+func diffConfig(config map[string]string) []change {
+	var changes []change
+	for name, value := range config {
+		f := flag.Lookup(name)
+		if f == nil || f.Value.String() == value {
+			continue
+		}
+		changes = append(changes, change{name: name, old: f.Value.String(), new: value})
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].name < changes[j].name
+	})
+	return changes
+}
+
+// changeFields turns changes into log fields, keeping secrets out of the log.
+func changeFields(changes []change) log.Fields {
+	fields := make(log.Fields, len(changes))
+	for _, ch := range changes {
+		if secretSettings[ch.name] {
+			fields[ch.name] = "(changed)"
+			continue
+		}
+		fields[ch.name] = strconv.Quote(ch.old) + " -> " + strconv.Quote(ch.new)
+	}
+	return fields
+}
+
+// reload reads the configuration, and any secrets in files, again and applies whatever has changed to the collectors
+// and storage, leaving them as they were if the new configuration doesn't work.
+func reload(args []string, p *pollers, sink *swapSink, reason string) {
+	logger := log.WithFields(log.Fields{
+		"reason": reason,
+	})
+	config, controllerConfigs, err := readConfig(args)
+	if err != nil {
+		logger.WithFields(log.Fields{
+			"err": err,
+		}).Error("Couldn't read configuration, keeping the old one")
+		return
+	}
+
+	var changes []change
+	for _, ch := range diffConfig(config) {
+		if restartOnly[ch.name] {
+			logger.WithFields(log.Fields{
+				"setting": ch.name,
+			}).Warn("Setting can only be changed by restarting, ignoring it")
+			continue
+		}
+		changes = append(changes, ch)
+	}
+	if config["configtoml"] != *configTOML {
+		// the controllers come from the file it was started with, until it's restarted
+		controllerConfigs = tomlControllerConfigs
+	}
+	controllersChanged := !reflect.DeepEqual(controllerConfigs, tomlControllerConfigs)
+	if len(changes) == 0 && !controllersChanged {
+		logger.Info("Configuration unchanged")
+		return
+	}
+	fields := changeFields(changes)
+	if controllersChanged {
+		// the controllers' settings may include secrets
+		fields[controllerSection] = "(changed)"
+	}
+	logger = logger.WithFields(fields)
+
+	// try out the new settings, going back to the old ones if they don't work
+	var reopen bool
+	for _, ch := range changes {
+		reopen = reopen || storageSettings[ch.name]
+	}
+	oldControllers := tomlControllerConfigs
+	tomlControllerConfigs = controllerConfigs
+	err = applyConfig(changes)
+	var controllers []*controller
+	if err == nil {
+		controllers, err = checkControllers()
+	}
+	if err == nil && reopen {
+		err = sink.reopen(func(old *storageSinks) (*storageSinks, error) {
+			return openStorage(*storage, old)
+		})
+	}
+	if err != nil {
+		undo := make([]change, len(changes))
+		for i, ch := range changes {
+			undo[i] = change{name: ch.name, old: ch.new, new: ch.old}
+		}
+		applyConfig(undo)
+		tomlControllerConfigs = oldControllers
+		logger.WithFields(log.Fields{
+			"err": err,
+		}).Error("New configuration doesn't work, keeping the old one")
+		return
+	}
+
+	setLogLevel()
+	status.setIntervals(*readyIntervals)
+	redactions.update(controllers)
+	p.update(controllers)
+	names := make([]string, len(controllers))
+	for i, c := range controllers {
+		names[i] = c.name
+	}
+	if exporter != nil {
+		exporter.SetOptions(promOptions())
+		exporter.Retain(names)
+	}
+	if apiServer != nil {
+		apiServer.Retain(names)
+	}
+	logger.Info("Configuration reloaded")
+}
+
+// applyConfig sets the flags to their new values.
+func applyConfig(changes []change) error {
+	for _, ch := range changes {
+		if err := flag.Set(ch.name, ch.new); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkControllers returns the controllers the flags say to poll, as long as all their settings make sense.
+func checkControllers() ([]*controller, error) {
+	controllers, err := configuredControllers()
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range controllers {
+		if err := c.check(); err != nil {
+			return nil, &configError{fmt.Errorf("controller %q: %w", c.name, err)}
+		}
+	}
+	return controllers, nil
+}
+
+// watchConfig checks the config files every interval, sending on the returned channel when any of them have changed.
+// It returns nil, which never sends, if there are no config files or interval.
+func watchConfig(ctx context.Context, interval time.Duration, paths ...string) <-chan struct{} {
+	var watched []string
+	for _, path := range paths {
+		if path != "" {
+			watched = append(watched, path)
+		}
+	}
+	if len(watched) == 0 || interval <= 0 {
+		return nil
+	}
+	changed := make(chan struct{}, 1)
+	go func() {
+		last := make([]os.FileInfo, len(watched))
+		for i, path := range watched {
+			last[i], _ = os.Stat(path)
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			for i, path := range watched {
+				// it may be missing for a moment while it's being replaced
+				info, err := os.Stat(path)
+				if err != nil {
+					continue
+				}
+				if last[i] != nil && info.ModTime().Equal(last[i].ModTime()) && info.Size() == last[i].Size() {
+					continue
+				}
+				last[i] = info
+				select {
+				case changed <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+	return changed
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dotwaffle/wifitracker/metrics"
+	"github.com/dotwaffle/wifitracker/store"
+	"github.com/dotwaffle/wifitracker/store/prometheus"
+	"github.com/namsral/flag"
+)
+
+// writeConfigFile writes a config file for the test, returning its path.
+func writeConfigFile(t *testing.T, lines ...string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "wifitracker.conf")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	return path
+}
+
+// keepFlags puts every flag back how it was once the test is done.
+func keepFlags(t *testing.T) {
+	t.Helper()
+	values := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		values[f.Name] = f.Value.String()
+	})
+	controllers := tomlControllerConfigs
+	t.Cleanup(func() {
+		for name, value := range values {
+			flag.Set(name, value)
+		}
+		tomlControllerConfigs = controllers
+	})
+}
+
+func TestReadConfig(t *testing.T) {
+	path := writeConfigFile(t,
+		"# polling",
+		"snmppollinterval 30s",
+		"snmpcommunity=secret",
+		"debug 1",
+		"spoolmaxmb 0x10",
+	)
+	config, _, err := readConfig([]string{"-config", path, "-snmpretries", "3"})
+	if err != nil {
+		t.Fatalf("readConfig: %v", err)
+	}
+
+	// values are written the way the flags write them, so only real changes show up
+	changes := diffConfig(config)
+	want := []change{
+		{name: "config", old: "", new: path},
+		{name: "debug", old: "false", new: "true"},
+		{name: "snmpcommunity", old: "public", new: "secret"},
+		{name: "snmppollinterval", old: "10s", new: "30s"},
+		{name: "snmpretries", old: "1", new: "3"},
+		{name: "spoolmaxmb", old: "1024", new: "16"},
+	}
+	if len(changes) != len(want) {
+		t.Fatalf("got changes %v, want %v", changes, want)
+	}
+	for i := range want {
+		if changes[i] != want[i] {
+			t.Errorf("change %d: got %v, want %v", i, changes[i], want[i])
+		}
+	}
+
+	fields := changeFields(changes)
+	if fields["snmpcommunity"] != "(changed)" {
+		t.Errorf("community logged as %v", fields["snmpcommunity"])
+	}
+	if fields["snmppollinterval"] != `"10s" -> "30s"` {
+		t.Errorf("poll interval logged as %v", fields["snmppollinterval"])
+	}
+
+	// the same file works as a Docker env-file
+	config, _, err = readConfig([]string{"-config", writeConfigFile(t, "SNMPCOMMUNITY=cheese", "Debug", "SNMPRETRIES=5")})
+	if err != nil {
+		t.Fatalf("readConfig with UPPERCASE keys: %v", err)
+	}
+	if config["snmpcommunity"] != "cheese" || config["debug"] != "true" || config["snmpretries"] != "5" {
+		t.Errorf("UPPERCASE keys read as community %q, debug %q, retries %q",
+			config["snmpcommunity"], config["debug"], config["snmpretries"])
+	}
+
+	for _, line := range []string{"snmppollinterval often", "snmpretries some", "nosuchsetting 1", "snmpretries"} {
+		if _, _, err := readConfig([]string{"-config", writeConfigFile(t, line)}); err == nil {
+			t.Errorf("%q: read without error", line)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	keepFlags(t)
+	flag.Set("storage", "file")
+	flag.Set("filelog", filepath.Join(t.TempDir(), "polls.json"))
+	sinks, err := openStorage(*storage, nil)
+	if err != nil {
+		t.Fatalf("openStorage: %v", err)
+	}
+	sink := &swapSink{sink: sinks}
+	defer sink.Close()
+	exporter = prometheus.New(promOptions())
+	defer func() { exporter = nil }()
+	exporter.Write(&store.Snapshot{Controller: "wlc1"})
+
+	// nothing gets to run, but they're still started and stopped as the controllers change
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	p := newPollers(ctx, sink)
+	defer func() {
+		for p.live > 0 {
+			p.exited(<-p.exits)
+		}
+	}()
+	p.start(newController("wlc1", "192.0.2.1"))
+	args := []string{"-storage", "file", "-filelog", *fileLog}
+
+	// a configuration that doesn't work leaves everything as it was
+	reload(append(args, "-config", writeConfigFile(t, "snmpcontrollers wlc1=192.0.2.1;schedule=whenever")), p, sink, "test")
+	reload(append(args, "-config", writeConfigFile(t, "storage nosuchbackend")), p, sink, "test")
+	reload(append(args, "-config", writeConfigFile(t, "snmppollinterval 0s")), p, sink, "test")
+	if *snmpControllers != "" || *storage != "file" || sink.sink != sinks || *snmpPollInterval <= 0 {
+		t.Errorf("broken configuration applied")
+	}
+
+	reload(append(args, "-config", writeConfigFile(t, "snmpcontrollers wlc2=192.0.2.2", "spoolmaxmb 10", "promclientbytes true")), p, sink, "test")
+	if *snmpControllers != "wlc2=192.0.2.2" {
+		t.Errorf("controllers not reloaded")
+	}
+	if sink.sink == sinks {
+		t.Errorf("storage not reopened")
+	}
+	if _, ok := p.running["wlc2"]; !ok || len(p.running) != 1 {
+		t.Errorf("got collectors %v, want just wlc2", p.running)
+	}
+
+	// the controllers in the TOML config file are polled once the controller list is gone
+	path := writeTOMLFile(t, "[[controller]]\nname = \"wlc3\"\nhost = \"192.0.2.3\"\ncommunity = \"a,b;c\"\n")
+	flag.Set("configtoml", path)
+	reload(append(args, "-configtoml", path, "-config", writeConfigFile(t, "spoolmaxmb 10", "promclientbytes true")), p, sink, "test")
+	if _, ok := p.running["wlc3"]; !ok || len(p.running) != 1 {
+		t.Errorf("got collectors %v, want just wlc3", p.running)
+	}
+
+	// metrics stop being served for controllers that have gone
+	rec := httptest.NewRecorder()
+	metrics.Handler(exporter).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if strings.Contains(rec.Body.String(), "wlc1") {
+		t.Errorf("metrics still served for wlc1:\n%s", rec.Body.String())
+	}
+	if !strings.Contains(rec.Body.String(), "wifitracker_client_bytes_dropped") {
+		t.Errorf("client byte metrics not turned on:\n%s", rec.Body.String())
+	}
+}
+
+// downSink is storage that can be down, remembering which controllers' snapshots were written to it.
+type downSink struct {
+	mu      sync.Mutex
+	down    bool
+	written []string
+	closed  bool
+}
+
+func (s *downSink) Write(snapshot *store.Snapshot) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.down {
+		return store.Transient(errors.New("database is down"))
+	}
+	s.written = append(s.written, snapshot.Controller)
+	return nil
+}
+
+func (s *downSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return nil
+}
+
+// spooledStorage opens storage of a single backend, behind a spool kept in dir.
+func spooledStorage(dir string, backend store.Sink, old *storageSinks) (*storageSinks, error) {
+	spooled, err := openSpool(dir, backend, old)
+	if err != nil {
+		return nil, err
+	}
+	sinks := &storageSinks{
+		Multi:  &store.Multi{},
+		spools: map[string]*spooledSink{dir: spooled},
+	}
+	sinks.Add("test", spooled)
+	return sinks, nil
+}
+
+func TestReopenSpooled(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "test")
+	first := &downSink{down: true}
+	old, err := spooledStorage(dir, first, nil)
+	if err != nil {
+		t.Fatalf("spooledStorage: %v", err)
+	}
+	sink := &swapSink{sink: old}
+	defer sink.Close()
+	for _, name := range []string{"wlc1", "wlc2", "wlc3"} {
+		if err := sink.Write(&store.Snapshot{Controller: name}); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	// the spool, still full, carries over to the new storage, rather than being opened again alongside the old one
+	second := &downSink{}
+	var reopened *storageSinks
+	if err := sink.reopen(func(old *storageSinks) (*storageSinks, error) {
+		reopened, err = spooledStorage(dir, second, old)
+		return reopened, err
+	}); err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	spooled := reopened.spools[dir]
+	if spooled.Spool != old.spools[dir].Spool {
+		t.Errorf("spool opened again, rather than carried over")
+	}
+	if !first.closed {
+		t.Errorf("old backend not closed")
+	}
+	if err := sink.Write(&store.Snapshot{Controller: "wlc4"}); err != nil {
+		t.Fatalf("Write after reopening: %v", err)
+	}
+
+	// everything goes to the new backend, once and in order
+	for deadline := time.Now().Add(10 * time.Second); spooled.Len() > 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("still %d spooled", spooled.Len())
+		}
+	}
+	second.mu.Lock()
+	defer second.mu.Unlock()
+	if want := []string{"wlc1", "wlc2", "wlc3", "wlc4"}; !reflect.DeepEqual(second.written, want) {
+		t.Errorf("written %v, want %v", second.written, want)
+	}
+	if len(first.written) != 0 {
+		t.Errorf("old backend written %v", first.written)
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Errorf("got %d files left in the spool", len(files))
+	}
+}
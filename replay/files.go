@@ -0,0 +1,66 @@
+package replay
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Extension is the file extension given to snapshot files.
+const Extension = ".walk"
+
+// Recorder writes a snapshot of every poll of a controller into a directory.
+type Recorder struct {
+	dir string
+}
+
+// NewRecorder records into dir, creating it if needed.
+func NewRecorder(dir string) (*Recorder, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Recorder{dir: dir}, nil
+}
+
+// Record writes the snapshot of a poll, returning the file it was written to.
+//
+// Files are named after the time of the poll, so that they sort into the order they were recorded in.
+func (r *Recorder) Record(s *Snapshot) (string, error) {
+	path := filepath.Join(r.dir, s.Time.UTC().Format("20060102T150405.000000000Z")+Extension)
+	return path, s.WriteFile(path)
+}
+
+// Player plays back the snapshots recorded of a controller, one per poll, in the order they were recorded.
+type Player struct {
+	files []string
+	next  int
+}
+
+// NewPlayer finds the snapshots recorded in dir.
+func NewPlayer(dir string) (*Player, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*"+Extension))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no snapshots found in %s", dir)
+	}
+	sort.Strings(files)
+	return &Player{files: files}, nil
+}
+
+// Next reads the snapshot for the next poll, returning io.EOF once they've all been played.
+func (p *Player) Next() (*Snapshot, string, error) {
+	if p.next >= len(p.files) {
+		return nil, "", io.EOF
+	}
+	path := p.files[p.next]
+	p.next++
+	s, err := ReadFile(path)
+	if err != nil {
+		return nil, path, fmt.Errorf("%s: %v", path, err)
+	}
+	return s, path, nil
+}
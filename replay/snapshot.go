@@ -0,0 +1,266 @@
+// Package replay records the SNMP walks made of a controller to snapshot files, and plays them back again.
+//
+// A snapshot file holds every walk made during a single poll, as plain text so that it can be read, diffed and
+// edited by hand:
+//
+//	# taken 2017-06-01T12:00:00.123456789Z
+//	# walk .1.3.6.1.4.1.14179.2.1.4.1.4
+//	.1.3.6.1.4.1.14179.2.1.4.1.4.0.17.34.51.68.85 OctetString 003a98aabbcc
+//	# walk .1.3.6.1.4.1.14179.2.1.6.1.1
+//	# error request timeout (after 1 retries)
+//
+// Each PDU is written as its OID, its type and its value. OCTET STRINGs are hex encoded, numbers are decimal, and
+// types without a value (such as Null or NoSuchInstance) have nothing after the type.
+package replay
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+)
+
+// Walker walks an SNMP table, just like a gosnmp session does.
+type Walker interface {
+	BulkWalkAll(rootOid string) ([]gosnmp.SnmpPDU, error)
+}
+
+// Walk is the result of a single BulkWalkAll.
+type Walk struct {
+	OID  string
+	PDUs []gosnmp.SnmpPDU
+	Err  string // the error the walk returned, if any
+}
+
+// Snapshot is every walk made during a single poll of a controller.
+type Snapshot struct {
+	Time  time.Time // when the poll started
+	Walks []Walk
+}
+
+// Add records the result of a walk.
+func (s *Snapshot) Add(oid string, pdus []gosnmp.SnmpPDU, err error) {
+	walk := Walk{
+		OID:  oid,
+		PDUs: pdus,
+	}
+	if err != nil {
+		walk.Err = err.Error()
+	}
+	s.Walks = append(s.Walks, walk)
+}
+
+// BulkWalkAll plays back the recorded walk of rootOid, which makes a Snapshot usable in place of a real SNMP session.
+func (s *Snapshot) BulkWalkAll(rootOid string) ([]gosnmp.SnmpPDU, error) {
+	for _, walk := range s.Walks {
+		if walk.OID != rootOid {
+			continue
+		}
+		if walk.Err != "" {
+			return walk.PDUs, errors.New(walk.Err)
+		}
+		return walk.PDUs, nil
+	}
+	return nil, fmt.Errorf("no walk of %s in snapshot", rootOid)
+}
+
+// typeNames are the names of the types that can be written to a snapshot.
+var typeNames = map[gosnmp.Asn1BER]string{
+	gosnmp.Integer:          "Integer",
+	gosnmp.BitString:        "BitString",
+	gosnmp.OctetString:      "OctetString",
+	gosnmp.Null:             "Null",
+	gosnmp.ObjectIdentifier: "ObjectIdentifier",
+	gosnmp.IPAddress:        "IPAddress",
+	gosnmp.Counter32:        "Counter32",
+	gosnmp.Gauge32:          "Gauge32",
+	gosnmp.TimeTicks:        "TimeTicks",
+	gosnmp.Opaque:           "Opaque",
+	gosnmp.Counter64:        "Counter64",
+	gosnmp.Uinteger32:       "Uinteger32",
+	gosnmp.NoSuchObject:     "NoSuchObject",
+	gosnmp.NoSuchInstance:   "NoSuchInstance",
+	gosnmp.EndOfMibView:     "EndOfMibView",
+}
+
+// Write writes the snapshot out in the snapshot file format.
+func (s *Snapshot) Write(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	if !s.Time.IsZero() {
+		fmt.Fprintf(bw, "# taken %s\n", s.Time.UTC().Format(time.RFC3339Nano))
+	}
+	for _, walk := range s.Walks {
+		fmt.Fprintf(bw, "# walk %s\n", walk.OID)
+		for _, pdu := range walk.PDUs {
+			value, err := formatValue(pdu)
+			if err != nil {
+				return fmt.Errorf("%s: %v", pdu.Name, err)
+			}
+			if value == "" {
+				fmt.Fprintf(bw, "%s %s\n", pdu.Name, typeNames[pdu.Type])
+			} else {
+				fmt.Fprintf(bw, "%s %s %s\n", pdu.Name, typeNames[pdu.Type], value)
+			}
+		}
+		if walk.Err != "" {
+			fmt.Fprintf(bw, "# error %s\n", strings.Replace(walk.Err, "\n", " ", -1))
+		}
+	}
+	return bw.Flush()
+}
+
+// WriteFile writes the snapshot to a file, creating or truncating it.
+func (s *Snapshot) WriteFile(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := s.Write(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Read reads a snapshot in the snapshot file format.
+func Read(r io.Reader) (*Snapshot, error) {
+	s := &Snapshot{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	var line int
+	for scanner.Scan() {
+		line++
+		text := strings.TrimRight(scanner.Text(), "\r")
+
+		switch {
+		case text == "":
+			continue
+		case strings.HasPrefix(text, "# taken "):
+			taken, err := time.Parse(time.RFC3339Nano, strings.TrimPrefix(text, "# taken "))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", line, err)
+			}
+			s.Time = taken
+			continue
+		case strings.HasPrefix(text, "# walk "):
+			s.Walks = append(s.Walks, Walk{OID: strings.TrimPrefix(text, "# walk ")})
+			continue
+		case strings.HasPrefix(text, "# error "):
+			if len(s.Walks) == 0 {
+				return nil, fmt.Errorf("line %d: error outside of a walk", line)
+			}
+			s.Walks[len(s.Walks)-1].Err = strings.TrimPrefix(text, "# error ")
+			continue
+		case strings.HasPrefix(text, "#"):
+			continue
+		}
+
+		if len(s.Walks) == 0 {
+			return nil, fmt.Errorf("line %d: PDU outside of a walk", line)
+		}
+		pdu, err := parsePDU(text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		walk := &s.Walks[len(s.Walks)-1]
+		walk.PDUs = append(walk.PDUs, pdu)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// ReadFile reads a snapshot from a file.
+func ReadFile(path string) (*Snapshot, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Read(f)
+}
+
+// formatValue renders the value of a PDU as it is written to a snapshot.
+func formatValue(pdu gosnmp.SnmpPDU) (string, error) {
+	switch pdu.Type {
+	case gosnmp.OctetString, gosnmp.BitString, gosnmp.Opaque:
+		b, ok := pdu.Value.([]byte)
+		if !ok {
+			return "", fmt.Errorf("%s value is %T, not bytes", typeNames[pdu.Type], pdu.Value)
+		}
+		return hex.EncodeToString(b), nil
+	case gosnmp.IPAddress:
+		// buggy agents can send an empty IpAddress, which gosnmp hands over as nil
+		if pdu.Value == nil {
+			return "", nil
+		}
+		return fmt.Sprint(pdu.Value), nil
+	case gosnmp.Integer, gosnmp.ObjectIdentifier,
+		gosnmp.Counter32, gosnmp.Gauge32, gosnmp.TimeTicks, gosnmp.Counter64, gosnmp.Uinteger32:
+		return fmt.Sprint(pdu.Value), nil
+	case gosnmp.Null, gosnmp.NoSuchObject, gosnmp.NoSuchInstance, gosnmp.EndOfMibView:
+		return "", nil
+	}
+	return "", fmt.Errorf("can't record SNMP type %v", pdu.Type)
+}
+
+// parsePDU reads a single PDU line of a snapshot, giving the value the same Go type gosnmp would have.
+func parsePDU(text string) (gosnmp.SnmpPDU, error) {
+	fields := strings.SplitN(text, " ", 3)
+	if len(fields) < 2 {
+		return gosnmp.SnmpPDU{}, fmt.Errorf("expected OID, type and value, got %q", text)
+	}
+	pdu := gosnmp.SnmpPDU{Name: fields[0]}
+	var value string
+	if len(fields) == 3 {
+		value = fields[2]
+	}
+
+	found := false
+	for t, name := range typeNames {
+		if name == fields[1] {
+			pdu.Type = t
+			found = true
+			break
+		}
+	}
+	if !found {
+		return pdu, fmt.Errorf("unknown SNMP type %q", fields[1])
+	}
+
+	var err error
+	switch pdu.Type {
+	case gosnmp.OctetString, gosnmp.BitString, gosnmp.Opaque:
+		pdu.Value, err = hex.DecodeString(value)
+	case gosnmp.IPAddress:
+		if value != "" {
+			pdu.Value = value
+		}
+	case gosnmp.ObjectIdentifier:
+		pdu.Value = value
+	case gosnmp.Integer:
+		pdu.Value, err = strconv.Atoi(value)
+	case gosnmp.Counter32, gosnmp.Gauge32:
+		var v uint64
+		v, err = strconv.ParseUint(value, 10, 32)
+		pdu.Value = uint(v)
+	case gosnmp.TimeTicks, gosnmp.Uinteger32:
+		var v uint64
+		v, err = strconv.ParseUint(value, 10, 32)
+		pdu.Value = uint32(v)
+	case gosnmp.Counter64:
+		pdu.Value, err = strconv.ParseUint(value, 10, 64)
+	}
+	if err != nil {
+		return pdu, fmt.Errorf("bad %s value %q: %v", fields[1], value, err)
+	}
+	return pdu, nil
+}
@@ -0,0 +1,129 @@
+package replay
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	want := &Snapshot{
+		Time: time.Date(2017, 6, 1, 12, 0, 0, 123456789, time.UTC),
+		Walks: []Walk{
+			{
+				OID: ".1.3.6.1.4.1.14179.2.1.4.1.4",
+				PDUs: []gosnmp.SnmpPDU{
+					{Name: ".1.3.6.1.4.1.14179.2.1.4.1.4.0.17.34.51.68.85", Type: gosnmp.OctetString, Value: []byte{0x00, 0x3a, 0x98, 0xaa, 0xbb, 0xcc}},
+					{Name: ".1.3.6.1.4.1.14179.2.1.4.1.4.0.17.34.51.68.86", Type: gosnmp.OctetString, Value: []byte{}},
+				},
+			},
+			{
+				OID: ".1.3.6.1.4.1.14179.2.1.4.1.2",
+				PDUs: []gosnmp.SnmpPDU{
+					{Name: ".1.3.6.1.4.1.14179.2.1.4.1.2.0.17.34.51.68.85", Type: gosnmp.IPAddress, Value: "192.0.2.10"},
+					{Name: ".1.3.6.1.4.1.14179.2.1.4.1.2.0.17.34.51.68.86", Type: gosnmp.IPAddress, Value: nil},
+				},
+			},
+			{
+				OID: ".1.3.6.1.4.1.14179.2.1.6.1",
+				PDUs: []gosnmp.SnmpPDU{
+					{Name: ".1.3.6.1.4.1.14179.2.1.6.1.1.0.17.34.51.68.85", Type: gosnmp.Integer, Value: -61},
+					{Name: ".1.3.6.1.4.1.14179.2.1.6.1.2.0.17.34.51.68.85", Type: gosnmp.Counter32, Value: uint(1234567)},
+					{Name: ".1.3.6.1.4.1.14179.2.1.6.1.3.0.17.34.51.68.85", Type: gosnmp.Counter64, Value: uint64(123456789012)},
+					{Name: ".1.3.6.1.4.1.14179.2.1.6.1.4.0.17.34.51.68.85", Type: gosnmp.Gauge32, Value: uint(42)},
+					{Name: ".1.3.6.1.4.1.14179.2.1.6.1.5.0.17.34.51.68.85", Type: gosnmp.TimeTicks, Value: uint32(8675309)},
+					{Name: ".1.3.6.1.4.1.14179.2.1.6.1.6.0.17.34.51.68.85", Type: gosnmp.ObjectIdentifier, Value: ".1.3.6.1.4.1.9"},
+					{Name: ".1.3.6.1.4.1.14179.2.1.6.1.7.0.17.34.51.68.85", Type: gosnmp.NoSuchInstance},
+				},
+			},
+			{
+				OID: ".1.3.6.1.4.1.14179.2.2.1.1.3",
+				Err: "request timeout (after 1 retries)",
+			},
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := want.Write(&buf); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	got, err := Read(&buf)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("round trip:\n got %+v\nwant %+v", got, want)
+	}
+
+	pdus, err := got.BulkWalkAll(".1.3.6.1.4.1.14179.2.2.1.1.3")
+	if err == nil || err.Error() != "request timeout (after 1 retries)" || len(pdus) != 0 {
+		t.Errorf("recorded error: got %v, %v", pdus, err)
+	}
+	if _, err := got.BulkWalkAll(".1.3.6.1.2.1.1"); err == nil {
+		t.Errorf("walk that was never recorded did not fail")
+	}
+}
+
+func TestReadRejectsGarbage(t *testing.T) {
+	for _, text := range []string{
+		".1.3.6.1.2.1.1.3.0 TimeTicks 1\n",
+		"# walk .1.3.6.1.2.1.1\n.1.3.6.1.2.1.1.3.0 Wibble 1\n",
+		"# walk .1.3.6.1.2.1.1\n.1.3.6.1.2.1.1.3.0 OctetString zz\n",
+		"# walk .1.3.6.1.2.1.1\n.1.3.6.1.2.1.1.3.0 Integer one\n",
+		"# walk .1.3.6.1.2.1.1\n.1.3.6.1.2.1.1.3.0\n",
+		"# taken yesterday\n",
+	} {
+		if _, err := Read(strings.NewReader(text)); err == nil {
+			t.Errorf("Read(%q) did not fail", text)
+		}
+	}
+}
+
+func TestRecordAndPlay(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "wlc1")
+	recorder, err := NewRecorder(dir)
+	if err != nil {
+		t.Fatalf("NewRecorder: %v", err)
+	}
+
+	// record out of order, to prove playback is by time
+	start := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	for _, poll := range []int{2, 0, 1} {
+		s := &Snapshot{Time: start.Add(time.Duration(poll) * 10 * time.Second)}
+		s.Add(".1.3.6.1.2.1.1.3", []gosnmp.SnmpPDU{
+			{Name: ".1.3.6.1.2.1.1.3.0", Type: gosnmp.TimeTicks, Value: uint32(poll)},
+		}, nil)
+		if _, err := recorder.Record(s); err != nil {
+			t.Fatalf("Record: %v", err)
+		}
+	}
+
+	player, err := NewPlayer(dir)
+	if err != nil {
+		t.Fatalf("NewPlayer: %v", err)
+	}
+	for poll := 0; poll < 3; poll++ {
+		s, _, err := player.Next()
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		pdus, err := s.BulkWalkAll(".1.3.6.1.2.1.1.3")
+		if err != nil || len(pdus) != 1 || pdus[0].Value != uint32(poll) {
+			t.Errorf("poll %d: got %+v, %v", poll, pdus, err)
+		}
+	}
+	if _, _, err := player.Next(); !errors.Is(err, io.EOF) {
+		t.Errorf("got %v after the last snapshot, want io.EOF", err)
+	}
+
+	if _, err := NewPlayer(t.TempDir()); err == nil {
+		t.Errorf("NewPlayer of an empty directory did not fail")
+	}
+}
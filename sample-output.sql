@@ -1,6 +1,7 @@
 SELECT
 	c.timestamp as timestamp,
-	c.clientip as ip,
+	c.controller as controller,
+	INET6_NTOA(c.clientip) as ip,
 	a.apname as ap,
 	c.clientssid as ssid,
 	CASE c.clientproto
@@ -18,6 +19,7 @@ JOIN aps as a
 	ON c.apmac = a.apmac
 WHERE
 	c.timestamp = a.timestamp
+	AND c.controller = a.controller
 ORDER BY
 	timestamp ASC,
 	ip ASC,
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/namsral/flag"
+)
+
+// the settings which can be read from a file instead, named by the setting with "_file" on the end, as Docker and
+// Kubernetes secrets are mounted
+var secretFiles = []string{"pgdsn", "privacykey", "snmpcommunity", "snmpv3authpass", "snmpv3privpass", "sqldsn", "sqlpass"}
+
+// readSecret reads a secret from a file, without the newline that's usually on the end.
+func readSecret(path string) (string, error) {
+	secret, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(secret), "\r\n"), nil
+}
+
+// readSecretFiles sets each secret with a file named by its "_file" flag from that file. A secret can't be set both
+// ways at once.
+func readSecretFiles(fs *flag.FlagSet) error {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	for _, name := range secretFiles {
+		path := fs.Lookup(name + "_file").Value.String()
+		if path == "" {
+			continue
+		}
+		if set[name] {
+			return &configError{fmt.Errorf("-%s and -%s_file are both set", name, name)}
+		}
+		secret, err := readSecret(path)
+		if err != nil {
+			return &configError{fmt.Errorf("-%s_file: %w", name, err)}
+		}
+		if err := fs.Set(name, secret); err != nil {
+			return &configError{fmt.Errorf("-%s_file: %v", name, err)}
+		}
+	}
+	return nil
+}
+
+// redactor is a log hook which masks every secret in the configuration wherever it turns up in a log entry, such as
+// inside an error from a database driver that quotes its DSN.
+type redactor struct {
+	mu      sync.RWMutex
+	secrets []string
+}
+
+// redactions masks the secrets of the configuration in every log entry.
+var redactions = &redactor{}
+
+func (r *redactor) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (r *redactor) Fire(entry *log.Entry) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if len(r.secrets) == 0 {
+		return nil
+	}
+	entry.Message = r.redact(entry.Message)
+
+	// the fields are shared with every other entry logged with them, perhaps at the same time, so any changes are made
+	// to a copy
+	var data log.Fields
+	for key, value := range entry.Data {
+		var text string
+		switch v := value.(type) {
+		case string:
+			text = v
+		case error:
+			text = v.Error()
+		case fmt.Stringer:
+			text = v.String()
+		default:
+			continue
+		}
+		redacted := r.redact(text)
+		if redacted == text {
+			continue
+		}
+		if data == nil {
+			data = make(log.Fields, len(entry.Data))
+			for k, v := range entry.Data {
+				data[k] = v
+			}
+		}
+		if _, ok := value.(error); ok {
+			data[key] = errors.New(redacted)
+		} else {
+			data[key] = redacted
+		}
+	}
+	if data != nil {
+		entry.Data = data
+	}
+	return nil
+}
+
+func (r *redactor) redact(s string) string {
+	for _, secret := range r.secrets {
+		s = strings.ReplaceAll(s, secret, "(redacted)")
+	}
+	return s
+}
+
+// update takes the secrets from the flags, and the controllers' own settings. Those left at their defaults aren't
+// secret.
+func (r *redactor) update(controllers []*controller) {
+	seen := make(map[string]bool)
+	var secrets []string
+	add := func(secret, def string) {
+		if secret == "" || secret == def || seen[secret] {
+			return
+		}
+		seen[secret] = true
+		secrets = append(secrets, secret)
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		if secretSettings[f.Name] {
+			add(f.Value.String(), f.DefValue)
+		}
+	})
+	community := flag.Lookup("snmpcommunity").DefValue
+	for _, c := range controllers {
+		add(c.community, community)
+		add(c.usm.authPass, "")
+		add(c.usm.privPass, "")
+	}
+
+	// a secret can contain another, so the longest go first
+	sort.Slice(secrets, func(i, j int) bool {
+		return len(secrets[i]) > len(secrets[j])
+	})
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.secrets = secrets
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/namsral/flag"
+)
+
+// writeSecret writes a secret into a file for the test, as Docker would mount it, returning its path.
+func writeSecret(t *testing.T, secret string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(path, []byte(secret), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	return path
+}
+
+func TestReadSecretFiles(t *testing.T) {
+	path := writeSecret(t, "hunter2\n")
+	config, _, err := readConfig([]string{"-sqlpass_file", path})
+	if err != nil {
+		t.Fatalf("readConfig: %v", err)
+	}
+	if config["sqlpass"] != "hunter2" {
+		t.Errorf("got sqlpass %q, want hunter2", config["sqlpass"])
+	}
+
+	t.Setenv("SNMPCOMMUNITY_FILE", writeSecret(t, "cheese"))
+	config, _, err = readConfig(nil)
+	if err != nil {
+		t.Fatalf("readConfig: %v", err)
+	}
+	if config["snmpcommunity"] != "cheese" {
+		t.Errorf("got snmpcommunity %q, want cheese", config["snmpcommunity"])
+	}
+
+	var cfgErr *configError
+	if _, _, err := readConfig([]string{"-sqlpass", "pass", "-sqlpass_file", path}); !errors.As(err, &cfgErr) {
+		t.Errorf("both set: got %v, want a configError", err)
+	}
+	if _, _, err := readConfig([]string{"-sqlpass_file", filepath.Join(t.TempDir(), "missing")}); !errors.As(err, &cfgErr) {
+		t.Errorf("missing file: got %v, want a configError", err)
+	}
+}
+
+func TestControllerSecretFiles(t *testing.T) {
+	controllers, err := parseControllers("wlc=10.0.0.1;version=3;authpass_file=" + writeSecret(t, "swordfish\n"))
+	if err != nil {
+		t.Fatalf("parseControllers: %v", err)
+	}
+	if controllers[0].usm.authPass != "swordfish" {
+		t.Errorf("got authpass %q, want swordfish", controllers[0].usm.authPass)
+	}
+	if _, err := parseControllers("wlc=10.0.0.1;community_file=/nonexistent"); err == nil {
+		t.Errorf("missing community file read without error")
+	}
+}
+
+func TestRedactor(t *testing.T) {
+	keepFlags(t)
+	flag.Set("sqlpass", "hunter2")
+	flag.Set("pgdsn", "postgres://wifi:letmein@db/wifi")
+	controllers, err := parseControllers("wlc=10.0.0.1;community=cheese")
+	if err != nil {
+		t.Fatalf("parseControllers: %v", err)
+	}
+
+	r := &redactor{}
+	r.update(controllers)
+	entry := &log.Entry{
+		Message: "couldn't connect with hunter2",
+		Data: log.Fields{
+			"err":       errors.New(`parse "postgres://wifi:letmein@db/wifi": invalid port`),
+			"community": "cheese",
+			"host":      "10.0.0.1",
+		},
+	}
+	r.Fire(entry)
+	if entry.Message != "couldn't connect with (redacted)" {
+		t.Errorf("message: got %q", entry.Message)
+	}
+	if err, _ := entry.Data["err"].(error); err == nil || err.Error() != `parse "(redacted)": invalid port` {
+		t.Errorf("err: got %v", entry.Data["err"])
+	}
+	if entry.Data["community"] != "(redacted)" || entry.Data["host"] != "10.0.0.1" {
+		t.Errorf("got fields %v", entry.Data)
+	}
+
+	// fields shared by entries logged at once are left alone
+	fields := log.Fields{"community": "cheese", "host": "10.0.0.1"}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			entry := &log.Entry{Message: "polling", Data: fields}
+			r.Fire(entry)
+			if entry.Data["community"] != "(redacted)" {
+				t.Errorf("shared fields: got %v", entry.Data)
+			}
+		}()
+	}
+	wg.Wait()
+	if fields["community"] != "cheese" {
+		t.Errorf("shared fields changed to %v", fields)
+	}
+
+	// the defaults aren't secret
+	flag.Set("sqlpass", "pass")
+	r.update(nil)
+	entry = &log.Entry{Message: "password", Data: log.Fields{}}
+	r.Fire(entry)
+	if entry.Message != "password" {
+		t.Errorf("default redacted: got %q", entry.Message)
+	}
+}
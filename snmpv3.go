@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gosnmp/gosnmp"
+)
+
+// sysObjectID is fetched once at startup to prove the SNMPv3 credentials work
+const sysObjectID = ".1.3.6.1.2.1.1.2.0"
+
+var (
+	authProtocols = map[string]gosnmp.SnmpV3AuthProtocol{
+		"MD5":    gosnmp.MD5,
+		"SHA":    gosnmp.SHA,
+		"SHA224": gosnmp.SHA224,
+		"SHA256": gosnmp.SHA256,
+		"SHA384": gosnmp.SHA384,
+		"SHA512": gosnmp.SHA512,
+	}
+	privProtocols = map[string]gosnmp.SnmpV3PrivProtocol{
+		"DES":     gosnmp.DES,
+		"AES":     gosnmp.AES,
+		"AES192":  gosnmp.AES192,
+		"AES256":  gosnmp.AES256,
+		"AES192C": gosnmp.AES192C,
+		"AES256C": gosnmp.AES256C,
+	}
+	secLevels = map[string]gosnmp.SnmpV3MsgFlags{
+		"noauthnopriv": gosnmp.NoAuthNoPriv,
+		"authnopriv":   gosnmp.AuthNoPriv,
+		"authpriv":     gosnmp.AuthPriv,
+	}
+)
+
+// usm holds the SNMPv3 User-based Security Model settings for a controller
+type usm struct {
+	secLevel  string
+	user      string
+	authProto string
+	authPass  string
+	privProto string
+	privPass  string
+	context   string
+	engineID  string // hex encoded, discovered from the agent if empty
+}
+
+// securityParameters validates the settings and turns them into something gosnmp understands
+func (u usm) securityParameters() (gosnmp.SnmpV3MsgFlags, *gosnmp.UsmSecurityParameters, error) {
+	flags, ok := secLevels[strings.ToLower(u.secLevel)]
+	if !ok {
+		return 0, nil, fmt.Errorf("unknown SNMPv3 security level %q", u.secLevel)
+	}
+	if u.user == "" {
+		return 0, nil, errors.New("SNMPv3 needs a user")
+	}
+	params := &gosnmp.UsmSecurityParameters{
+		UserName:               u.user,
+		AuthenticationProtocol: gosnmp.NoAuth,
+		PrivacyProtocol:        gosnmp.NoPriv,
+	}
+
+	if u.engineID != "" {
+		engineID, err := hex.DecodeString(strings.Replace(u.engineID, ":", "", -1))
+		if err != nil {
+			return 0, nil, fmt.Errorf("SNMPv3 engine ID %q is not hex: %v", u.engineID, err)
+		}
+		params.AuthoritativeEngineID = string(engineID)
+	}
+
+	if flags == gosnmp.NoAuthNoPriv {
+		return flags, params, nil
+	}
+
+	if params.AuthenticationProtocol, ok = authProtocols[strings.ToUpper(u.authProto)]; !ok {
+		return 0, nil, fmt.Errorf("unknown SNMPv3 auth protocol %q", u.authProto)
+	}
+	// RFC 3414 demands passphrases of at least eight characters, and agents will refuse anything shorter
+	if len(u.authPass) < 8 {
+		return 0, nil, errors.New("SNMPv3 auth password must be at least 8 characters")
+	}
+	params.AuthenticationPassphrase = u.authPass
+
+	if flags == gosnmp.AuthNoPriv {
+		return flags, params, nil
+	}
+
+	if params.PrivacyProtocol, ok = privProtocols[strings.ToUpper(u.privProto)]; !ok {
+		return 0, nil, fmt.Errorf("unknown SNMPv3 priv protocol %q", u.privProto)
+	}
+	if len(u.privPass) < 8 {
+		return 0, nil, errors.New("SNMPv3 priv password must be at least 8 characters")
+	}
+	params.PrivacyPassphrase = u.privPass
+
+	return flags, params, nil
+}
+
+// explainUSMError turns the agent's USM report into something a human can act on
+func (u usm) explainUSMError(err error) error {
+	switch {
+	case errors.Is(err, gosnmp.ErrUnknownUsername):
+		return fmt.Errorf("agent does not know SNMPv3 user %q", u.user)
+	case errors.Is(err, gosnmp.ErrWrongDigest):
+		return fmt.Errorf("agent rejected authentication for user %q, check the auth protocol (%s) and password", u.user, u.authProto)
+	case errors.Is(err, gosnmp.ErrDecryption):
+		return fmt.Errorf("agent could not decrypt our request for user %q, check the priv protocol (%s) and password", u.user, u.privProto)
+	case errors.Is(err, gosnmp.ErrUnknownSecurityLevel):
+		return fmt.Errorf("agent does not allow security level %s for user %q", u.secLevel, u.user)
+	case errors.Is(err, gosnmp.ErrUnknownEngineID):
+		return fmt.Errorf("agent does not have engine ID %q, try leaving it unset to discover it", u.engineID)
+	case errors.Is(err, gosnmp.ErrNotInTimeWindow):
+		return errors.New("agent says we are outside its time window, even after rediscovery")
+	}
+	return fmt.Errorf("no usable response from agent (check host, port and SNMPv3 credentials): %v", err)
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/dotwaffle/wifitracker/store"
+	"github.com/dotwaffle/wifitracker/store/filelog"
+	"github.com/dotwaffle/wifitracker/store/migrate"
+	"github.com/dotwaffle/wifitracker/store/mysql"
+	"github.com/dotwaffle/wifitracker/store/postgres"
+	"github.com/dotwaffle/wifitracker/store/spool"
+	"github.com/dotwaffle/wifitracker/store/sqlite"
+)
+
+// openStorage opens every storage backend listed, comma separated, in names, each behind its own spool if -spooldir is
+// set, along with the metrics and API if they're being served. When it's to replace old storage, any spools the old
+// storage has in the same directories are carried over, rather than opened again.
+func openStorage(names string, old *storageSinks) (*storageSinks, error) {
+	backends, err := storageBackends(names)
+	if err != nil {
+		return nil, err
+	}
+
+	sinks := &storageSinks{
+		Multi:  &store.Multi{},
+		spools: make(map[string]*spooledSink),
+	}
+	for _, name := range backends {
+		sink, err := openSink(name)
+		if err != nil {
+			sinks.Close()
+			return nil, fmt.Errorf("storage %q: %w", name, err)
+		}
+		sink = &instrumentedSink{name: name, sink: sink}
+		if *spoolDir != "" {
+			dir := filepath.Join(*spoolDir, name)
+			spooled, err := openSpool(dir, sink, old)
+			if err != nil {
+				sink.Close()
+				sinks.Close()
+				return nil, fmt.Errorf("storage %q: spool: %w", name, err)
+			}
+			sinks.spools[dir] = spooled
+			sink = spooled
+		}
+		sinks.Add(name, sink)
+	}
+	// metrics and the API are only ever served from memory, so never need spooling
+	if exporter != nil {
+		sinks.Add("prometheus", exporter)
+	}
+	if apiServer != nil {
+		sinks.Add("api", apiServer)
+	}
+	status.storage(backends)
+	return sinks, nil
+}
+
+// spoolOptions are the spool limits from the flags.
+func spoolOptions() spool.Options {
+	return spool.Options{
+		MaxSize: *spoolMaxMB << 20,
+		MaxAge:  *spoolMaxAge,
+	}
+}
+
+// openSpool puts a spool, kept in dir, in front of the backend. If the old storage already has a spool there, that's
+// carried over instead, with the backend going behind it once the new storage takes over.
+func openSpool(dir string, backend store.Sink, old *storageSinks) (*spooledSink, error) {
+	if old != nil {
+		if carried, ok := old.spools[dir]; ok {
+			return &spooledSink{Spool: carried.Spool, backend: carried.backend, next: backend}, nil
+		}
+	}
+	swappable := &swapSink{sink: backend}
+	s, err := spool.Open(dir, swappable, spoolOptions())
+	if err != nil {
+		return nil, err
+	}
+	return &spooledSink{Spool: s, backend: swappable}, nil
+}
+
+// storageSinks is all the storage being written to, along with the spools in front of it, by directory.
+type storageSinks struct {
+	*store.Multi
+	spools map[string]*spooledSink
+}
+
+// takeOver puts the new backends behind the spools carried over from the old storage, once the old storage is no
+// longer being written to.
+func (s *storageSinks) takeOver(old *storageSinks) {
+	for dir, spooled := range s.spools {
+		if spooled.next == nil {
+			continue
+		}
+		old.spools[dir].handedOver = true
+		spooled.SetOptions(spoolOptions())
+		if err := spooled.backend.swap(spooled.next).Close(); err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Warn("Couldn't close old storage")
+		}
+		spooled.next = nil
+	}
+}
+
+// spooledSink is a storage backend behind a spool. The backend sits in a swapSink of its own, so that reopening the
+// storage can carry the spool, and whatever's waiting in it, over to the new storage with the new backend behind it,
+// rather than having two spools working on the same directory at once.
+type spooledSink struct {
+	*spool.Spool
+	backend *swapSink
+	// next is the backend to put behind a spool carried over from the old storage, once the new storage takes over
+	next store.Sink
+	// handedOver is set once new storage has taken the spool over, so closing the old storage leaves it running
+	handedOver bool
+}
+
+// Close closes the spool and the backend behind it, unless they've been handed over to new storage. New storage that
+// never took over only closes the backend it would have put behind the spool.
+func (s *spooledSink) Close() error {
+	switch {
+	case s.next != nil:
+		return s.next.Close()
+	case s.handedOver:
+		return nil
+	}
+	return s.Spool.Close()
+}
+
+// swapSink is storage that can be replaced, when the configuration is reloaded, while collectors are writing to it.
+type swapSink struct {
+	mu   sync.RWMutex
+	sink store.Sink
+}
+
+func (s *swapSink) Write(snapshot *store.Snapshot) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.sink.Write(snapshot)
+}
+
+func (s *swapSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sink.Close()
+}
+
+// swap replaces the storage, once any writes to it have finished, returning the old storage.
+func (s *swapSink) swap(sink store.Sink) store.Sink {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old := s.sink
+	s.sink = sink
+	return old
+}
+
+// reopen replaces the storage with whatever open returns, given the old storage, and closes the old storage, or keeps
+// the old storage if open fails. The old storage carries on being written to while the new storage is opened, and
+// writes only wait for the swap, after which the new storage takes over the old storage's spools.
+func (s *swapSink) reopen(open func(old *storageSinks) (*storageSinks, error)) error {
+	s.mu.RLock()
+	old, _ := s.sink.(*storageSinks)
+	s.mu.RUnlock()
+	sinks, err := open(old)
+	if err != nil {
+		return err
+	}
+	replaced := s.swap(sinks)
+	if old != nil {
+		sinks.takeOver(old)
+	}
+	if err := replaced.Close(); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Warn("Couldn't close old storage")
+	}
+	return nil
+}
+
+// storageBackends splits up a comma separated list of storage backends.
+func storageBackends(names string) ([]string, error) {
+	var backends []string
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if seen[name] {
+			return nil, &configError{fmt.Errorf("storage %q listed twice", name)}
+		}
+		seen[name] = true
+		backends = append(backends, name)
+	}
+	if len(backends) == 0 {
+		return nil, &configError{fmt.Errorf("no storage configured")}
+	}
+	return backends, nil
+}
+
+// checkStorage makes sure every storage backend listed, comma separated, in names is configured well enough to open,
+// without opening it.
+func checkStorage(names string) error {
+	backends, err := storageBackends(names)
+	if err != nil {
+		return err
+	}
+	for _, name := range backends {
+		if err := checkSink(name); err != nil {
+			return fmt.Errorf("storage %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// checkSink makes sure a single storage backend has the flags it needs.
+func checkSink(name string) error {
+	switch name {
+	case "mysql":
+		if *sqlBatchSize < 0 {
+			return &configError{fmt.Errorf("-sqlbatchsize can't be negative (0 means the default of %d)", mysql.DefaultBatchSize)}
+		}
+	case "postgres":
+		if *pgDSN == "" {
+			return &configError{fmt.Errorf("-pgdsn must be set")}
+		}
+	case "sqlite":
+	case "file":
+		if *fileLog == "" {
+			return &configError{fmt.Errorf("-filelog must be set")}
+		}
+	default:
+		return &configError{fmt.Errorf("unknown storage backend (mysql, postgres, sqlite, file)")}
+	}
+	return nil
+}
+
+// openSink opens a single storage backend, configured by its flags.
+func openSink(name string) (store.Sink, error) {
+	if err := checkSink(name); err != nil {
+		return nil, err
+	}
+	switch name {
+	case "mysql":
+		dbDSN := mysqlDSN()
+		log.WithFields(log.Fields{
+			"dsn": mysql.RedactDSN(dbDSN),
+		}).Debug("Opening MySQL storage")
+		return mysql.Open(dbDSN, mysql.Options{
+			AutoMigrate: *autoMigrate,
+			BatchSize:   *sqlBatchSize,
+		})
+	case "postgres":
+		return postgres.Open(*pgDSN, postgres.Options{
+			AutoMigrate:   *autoMigrate,
+			Timescale:     *pgTimescale,
+			ChunkInterval: *pgChunkInterval,
+			CompressAfter: *pgCompressAfter,
+		})
+	case "sqlite":
+		log.WithFields(log.Fields{
+			"path": *sqlitePath,
+		}).Debug("Opening SQLite storage")
+		return sqlite.Open(*sqlitePath, *autoMigrate)
+	case "file":
+		log.WithFields(log.Fields{
+			"path": *fileLog,
+		}).Debug("Opening file storage")
+		return filelog.Open(*fileLog)
+	}
+	return nil, &configError{fmt.Errorf("unknown storage backend (mysql, postgres, sqlite, file)")}
+}
+
+// mysqlDSN builds the MySQL DSN from its flags, unless it's been given whole.
+func mysqlDSN() string {
+	if *sqlDSN != "" {
+		return *sqlDSN
+	}
+	return fmt.Sprintf("%s:%s@tcp(%s)/%s?tls=%s",
+		*sqlUser,
+		*sqlPass,
+		net.JoinHostPort(*sqlHost, strconv.Itoa(*sqlPort)),
+		*sqlDB,
+		*sqlTLS)
+}
+
+// openMigrator connects to the database behind a storage backend, without touching its schema, returning nil if the
+// backend doesn't have a schema.
+func openMigrator(name string) (*migrate.Migrator, *sql.DB, error) {
+	var db *sql.DB
+	var err error
+	var migrator func(*sql.DB) (*migrate.Migrator, error)
+	switch name {
+	case "mysql":
+		db, err = mysql.Connect(mysqlDSN())
+		migrator = mysql.Migrator
+	case "postgres":
+		if *pgDSN == "" {
+			return nil, nil, fmt.Errorf("-pgdsn must be set")
+		}
+		db, err = postgres.Connect(*pgDSN)
+		migrator = postgres.Migrator
+	case "sqlite":
+		db, err = sqlite.Connect(*sqlitePath)
+		migrator = sqlite.Migrator
+	case "file":
+		return nil, nil, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown storage backend (mysql, postgres, sqlite, file)")
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	m, err := migrator(db)
+	if err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+	return m, db, nil
+}
@@ -0,0 +1,49 @@
+// Package filelog appends snapshots to a file, one JSON object per line.
+//
+// It's handy for feeding other tools, or for keeping a copy of everything that was written to a database.
+package filelog
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+
+	"github.com/dotwaffle/wifitracker/store"
+)
+
+// Sink appends snapshots to a file.
+type Sink struct {
+	mu      sync.Mutex
+	f       *os.File
+	encoder *json.Encoder
+}
+
+// Open opens a file for appending, creating it if needed.
+func Open(path string) (*Sink, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &Sink{
+		f:       f,
+		encoder: json.NewEncoder(f),
+	}, nil
+}
+
+// Write appends the snapshot as a single line of JSON.
+func (s *Sink) Write(snapshot *store.Snapshot) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.encoder.Encode(snapshot)
+}
+
+// Close makes sure everything written has made it to disk, and closes the file.
+func (s *Sink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.f.Sync(); err != nil {
+		s.f.Close()
+		return err
+	}
+	return s.f.Close()
+}
@@ -0,0 +1,62 @@
+package filelog
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dotwaffle/wifitracker/decoder"
+	"github.com/dotwaffle/wifitracker/store"
+)
+
+func TestAppend(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "polls.jsonl")
+	want := []*store.Snapshot{
+		{
+			Controller: "wlc1",
+			Time:       time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC),
+			Clients:    []decoder.Client{{APMAC: "003a98aabbcc", IP: "192.0.2.10", MAC: "001122334455", SSID: "eduroam", RSSI: -61}},
+			APs:        []decoder.AP{{MAC: "003a98aabbcc", Name: "ap-lobby", Channel24GHz: 6, Channel5GHz: 36}},
+		},
+		{
+			Controller: "wlc2",
+			Time:       time.Date(2017, 6, 1, 12, 0, 10, 0, time.UTC),
+		},
+	}
+
+	// a second Open appends rather than truncating
+	for _, s := range want {
+		sink, err := Open(path)
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		if err := sink.Write(s); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		if err := sink.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("os.Open: %v", err)
+	}
+	defer f.Close()
+	var got []*store.Snapshot
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		s := &store.Snapshot{}
+		if err := json.Unmarshal(scanner.Bytes(), s); err != nil {
+			t.Fatalf("line %d: %v", len(got)+1, err)
+		}
+		got = append(got, s)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v\nwant %+v", got, want)
+	}
+}
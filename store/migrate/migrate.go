@@ -0,0 +1,283 @@
+// Package migrate keeps a database schema up to date, by applying numbered migrations in order.
+//
+// Migrations are SQL files named like "0002_add_vlan.sql", embedded in the binary by each storage backend. The
+// number is the schema version the migration takes the database to, and every migration applied is recorded in the
+// schema_migrations table, so a database always knows which version it's at. A file can hold several statements, each
+// ending in a semicolon at the end of a line.
+package migrate
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Migration is a single change to the schema.
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+// Status is a migration, and when it was applied to the database, if it has been.
+type Status struct {
+	Migration
+	Applied time.Time
+}
+
+// The ways a database can be the wrong version.
+var (
+	// ErrTooNew is returned when the database has had migrations applied that this binary doesn't know about.
+	ErrTooNew = errors.New("database schema is newer than this version of wifitracker understands")
+	// ErrPending is returned when migrations need applying, but applying them automatically is turned off.
+	ErrPending = errors.New("database schema needs migrating, run the migrate subcommand")
+)
+
+// the table recording which migrations have been applied, portable between every database used
+const sqlCreateVersions = `
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER NOT NULL PRIMARY KEY,
+		name VARCHAR(255) NOT NULL,
+		applied VARCHAR(64) NOT NULL
+	)
+`
+
+// fileName is how migration files are named.
+var fileName = regexp.MustCompile(`^([0-9]+)_([a-z0-9_]+)\.sql$`)
+
+// Load reads every migration in a directory, oldest first.
+func Load(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var migrations []Migration
+	seen := make(map[int]string)
+	for _, entry := range entries {
+		if entry.IsDir() || path.Ext(entry.Name()) != ".sql" {
+			continue
+		}
+		match := fileName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("%s: migrations must be named like 0001_name.sql", entry.Name())
+		}
+		version, err := strconv.Atoi(match[1])
+		if err != nil || version < 1 {
+			return nil, fmt.Errorf("%s: bad version", entry.Name())
+		}
+		if other, ok := seen[version]; ok {
+			return nil, fmt.Errorf("%s: version %d is already used by %s", entry.Name(), version, other)
+		}
+		seen[version] = entry.Name()
+
+		text, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, Migration{
+			Version: version,
+			Name:    match[2],
+			SQL:     string(text),
+		})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// Migrator applies migrations to a database.
+type Migrator struct {
+	db         *sql.DB
+	migrations []Migration
+
+	// Numbered uses $1 style placeholders, as Postgres wants, rather than ?
+	Numbered bool
+}
+
+// New returns a Migrator for a database, with the migrations it should be at.
+func New(db *sql.DB, migrations []Migration) *Migrator {
+	return &Migrator{
+		db:         db,
+		migrations: migrations,
+	}
+}
+
+// Latest is the version the migrations take the database to.
+func (m *Migrator) Latest() int {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+// applied finds every migration that has been applied, creating the schema_migrations table if needed.
+func (m *Migrator) applied() (map[int]time.Time, error) {
+	if _, err := m.db.Exec(sqlCreateVersions); err != nil {
+		return nil, fmt.Errorf("couldn't create schema_migrations: %v", err)
+	}
+	rows, err := m.db.Query("SELECT version, applied FROM schema_migrations")
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read schema_migrations: %v", err)
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var at string
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, fmt.Errorf("couldn't read schema_migrations: %v", err)
+		}
+		// a bad time isn't worth failing over, it's only there for people to look at
+		applied[version], _ = time.Parse(time.RFC3339, at)
+	}
+	return applied, rows.Err()
+}
+
+// Version is the newest migration applied to the database, or zero if there haven't been any.
+func (m *Migrator) Version() (int, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return 0, err
+	}
+	var version int
+	for v := range applied {
+		if v > version {
+			version = v
+		}
+	}
+	return version, nil
+}
+
+// Status lists every migration known, and when each was applied.
+func (m *Migrator) Status() ([]Status, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]Status, 0, len(m.migrations))
+	for _, migration := range m.migrations {
+		statuses = append(statuses, Status{
+			Migration: migration,
+			Applied:   applied[migration.Version],
+		})
+	}
+	return statuses, nil
+}
+
+// Pending lists the migrations that haven't been applied yet, returning ErrTooNew if the database is ahead of them.
+func (m *Migrator) Pending() ([]Migration, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+	for version := range applied {
+		if version > m.Latest() {
+			return nil, fmt.Errorf("%w (database is at version %d, wifitracker knows up to %d)", ErrTooNew, version, m.Latest())
+		}
+	}
+
+	var pending []Migration
+	for _, migration := range m.migrations {
+		if _, ok := applied[migration.Version]; !ok {
+			pending = append(pending, migration)
+		}
+	}
+	return pending, nil
+}
+
+// Up applies every pending migration in order, returning those that were applied.
+func (m *Migrator) Up() ([]Migration, error) {
+	pending, err := m.Pending()
+	if err != nil {
+		return nil, err
+	}
+
+	var done []Migration
+	for _, migration := range pending {
+		if err := m.apply(migration); err != nil {
+			return done, fmt.Errorf("migration %d (%s): %v", migration.Version, migration.Name, err)
+		}
+		log.WithFields(log.Fields{
+			"version": migration.Version,
+			"name":    migration.Name,
+		}).Info("Applied database migration")
+		done = append(done, migration)
+	}
+	return done, nil
+}
+
+// Ready makes sure the database is at the latest version, migrating it if allowed to.
+func (m *Migrator) Ready(autoMigrate bool) ([]Migration, error) {
+	pending, err := m.Pending()
+	if err != nil {
+		return nil, err
+	}
+	if len(pending) == 0 {
+		return nil, nil
+	}
+	if !autoMigrate {
+		return nil, fmt.Errorf("%w (%d pending)", ErrPending, len(pending))
+	}
+	return m.Up()
+}
+
+// apply runs a single migration and records it.
+//
+// Some databases (MySQL) commit schema changes as they go, so a migration that fails part way can't always be rolled
+// back, which is why each should do as little as possible.
+func (m *Migrator) apply(migration Migration) error {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, statement := range statements(migration.SQL) {
+		if _, err := tx.Exec(statement); err != nil {
+			return err
+		}
+	}
+
+	insert := "INSERT INTO schema_migrations(version, name, applied) VALUES (?, ?, ?)"
+	if m.Numbered {
+		insert = "INSERT INTO schema_migrations(version, name, applied) VALUES ($1, $2, $3)"
+	}
+	if _, err := tx.Exec(insert, migration.Version, migration.Name, time.Now().UTC().Format(time.RFC3339)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// statements splits a migration into the statements in it, which end with a semicolon at the end of a line.
+func statements(text string) []string {
+	var found []string
+	var current []string
+	for _, line := range strings.Split(text, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+		current = append(current, line)
+		if strings.HasSuffix(trimmed, ";") {
+			found = append(found, strings.Join(current, "\n"))
+			current = nil
+		}
+	}
+	if len(current) > 0 {
+		found = append(found, strings.Join(current, "\n"))
+	}
+	return found
+}
@@ -0,0 +1,144 @@
+package migrate
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"testing/fstest"
+
+	_ "modernc.org/sqlite"
+)
+
+var testMigrations = fstest.MapFS{
+	"migrations/0001_create_tables.sql": {Data: []byte(`
+-- the first table
+CREATE TABLE clients (
+	id INTEGER PRIMARY KEY,
+	clientmac TEXT
+);
+CREATE TABLE aps (id INTEGER PRIMARY KEY);
+`)},
+	"migrations/0002_add_vlan.sql": {Data: []byte("ALTER TABLE clients ADD COLUMN vlan INTEGER;\n")},
+	"migrations/README":            {Data: []byte("not a migration")},
+}
+
+func testDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "migrate.db"))
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestLoad(t *testing.T) {
+	migrations, err := Load(testMigrations, "migrations")
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	var versions []int
+	var names []string
+	for _, m := range migrations {
+		versions = append(versions, m.Version)
+		names = append(names, m.Name)
+	}
+	if !reflect.DeepEqual(versions, []int{1, 2}) || !reflect.DeepEqual(names, []string{"create_tables", "add_vlan"}) {
+		t.Errorf("got versions %v names %v", versions, names)
+	}
+
+	for name, fsys := range map[string]fstest.MapFS{
+		"duplicate": {
+			"m/0001_one.sql": {Data: []byte("SELECT 1;")},
+			"m/1_two.sql":    {Data: []byte("SELECT 2;")},
+		},
+		"misnamed": {"m/one.sql": {Data: []byte("SELECT 1;")}},
+		"zero":     {"m/0000_none.sql": {Data: []byte("SELECT 1;")}},
+	} {
+		if _, err := Load(fsys, "m"); err == nil {
+			t.Errorf("%s: Load did not fail", name)
+		}
+	}
+}
+
+func TestUp(t *testing.T) {
+	db := testDB(t)
+	migrations, err := Load(testMigrations, "migrations")
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	// only knowing the first migration, as an older binary would
+	old := New(db, migrations[:1])
+	if _, err := old.Ready(false); !errors.Is(err, ErrPending) {
+		t.Errorf("Ready without migrating: got %v, want ErrPending", err)
+	}
+	if applied, err := old.Ready(true); err != nil || len(applied) != 1 {
+		t.Fatalf("Ready: applied %v, %v", applied, err)
+	}
+
+	m := New(db, migrations)
+	if version, err := m.Version(); err != nil || version != 1 {
+		t.Errorf("Version: got %d, %v, want 1", version, err)
+	}
+	if applied, err := m.Up(); err != nil || len(applied) != 1 || applied[0].Version != 2 {
+		t.Fatalf("Up: applied %v, %v", applied, err)
+	}
+	if _, err := db.Exec("INSERT INTO clients(clientmac, vlan) VALUES ('001122334455', 10)"); err != nil {
+		t.Errorf("migrated table: %v", err)
+	}
+	if applied, err := m.Up(); err != nil || len(applied) != 0 {
+		t.Errorf("Up again: applied %v, %v", applied, err)
+	}
+
+	statuses, err := m.Status()
+	if err != nil {
+		t.Fatalf("Status: %v", err)
+	}
+	for _, status := range statuses {
+		if status.Applied.IsZero() {
+			t.Errorf("migration %d not recorded as applied", status.Version)
+		}
+	}
+
+	// the older binary has to refuse the newer database
+	if _, err := old.Ready(true); !errors.Is(err, ErrTooNew) {
+		t.Errorf("older Ready: got %v, want ErrTooNew", err)
+	}
+}
+
+func TestFailedMigration(t *testing.T) {
+	db := testDB(t)
+	m := New(db, []Migration{
+		{Version: 1, Name: "good", SQL: "CREATE TABLE aps (id INTEGER PRIMARY KEY);"},
+		{Version: 2, Name: "bad", SQL: "ALTER TABLE nothing ADD COLUMN vlan INTEGER;"},
+	})
+	applied, err := m.Up()
+	if err == nil || len(applied) != 1 {
+		t.Fatalf("Up: applied %v, %v", applied, err)
+	}
+	if version, err := m.Version(); err != nil || version != 1 {
+		t.Errorf("Version: got %d, %v, want 1", version, err)
+	}
+}
+
+func TestStatements(t *testing.T) {
+	got := statements(`
+-- a comment
+CREATE TABLE a (
+	id INTEGER
+);
+
+CREATE INDEX a_id ON a (id);
+SELECT 1`)
+	want := []string{
+		"CREATE TABLE a (\n\tid INTEGER\n);",
+		"CREATE INDEX a_id ON a (id);",
+		"SELECT 1",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q\nwant %q", got, want)
+	}
+}
@@ -0,0 +1,98 @@
+package mysql
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// a prepared statement can't have more placeholders than this
+const maxPlaceholders = 65535
+
+// how much of max_allowed_packet is kept back for the packet headers and the like
+const packetHeadroom = 4096
+
+// a batch builds multi-row INSERTs for one table, running one whenever adding another row would make it too long.
+type batch struct {
+	exec func(query string, args ...interface{}) (sql.Result, error)
+
+	table   string
+	prefix  string // everything up to the first row
+	row     string // the placeholders for one row
+	maxRows int
+	maxSize int
+
+	args []interface{}
+	rows int
+	size int
+
+	// how many INSERTs have been run, for the logs
+	inserts int
+}
+
+// newBatch returns a batch inserting into the columns of table, with at most maxRows rows per INSERT, and each
+// INSERT sent in a packet no bigger than maxPacket bytes.
+func newBatch(exec func(string, ...interface{}) (sql.Result, error), table string, columns []string, maxRows, maxPacket int) *batch {
+	if limit := maxPlaceholders / len(columns); maxRows > limit {
+		maxRows = limit
+	}
+	b := &batch{
+		exec:    exec,
+		table:   table,
+		prefix:  fmt.Sprintf("INSERT INTO %s(%s) VALUES ", table, strings.Join(columns, ", ")),
+		row:     "(" + strings.TrimSuffix(strings.Repeat("?,", len(columns)), ",") + ")",
+		maxRows: maxRows,
+		maxSize: maxPacket - packetHeadroom,
+	}
+	b.size = len(b.prefix)
+	return b
+}
+
+// add queues up a row, running the INSERT so far first if the row won't fit.
+func (b *batch) add(args ...interface{}) error {
+	size := len(b.row) + 1
+	for _, arg := range args {
+		size += argSize(arg)
+	}
+	if b.rows > 0 && (b.rows >= b.maxRows || b.size+size > b.maxSize) {
+		if err := b.flush(); err != nil {
+			return err
+		}
+	}
+	b.args = append(b.args, args...)
+	b.rows++
+	b.size += size
+	return nil
+}
+
+// flush runs the INSERT for any rows still queued up.
+func (b *batch) flush() error {
+	if b.rows == 0 {
+		return nil
+	}
+	query := b.prefix + strings.TrimSuffix(strings.Repeat(b.row+",", b.rows), ",")
+	_, err := b.exec(query, b.args...)
+	b.inserts++
+	b.args = b.args[:0]
+	b.rows = 0
+	b.size = len(b.prefix)
+	if err != nil {
+		return fmt.Errorf("insert into %s: %w", b.table, err)
+	}
+	return nil
+}
+
+// argSize is a generous guess at how many bytes an argument takes up on the wire: its type, a length, and the value.
+func argSize(arg interface{}) int {
+	switch v := arg.(type) {
+	case string:
+		return 11 + len(v)
+	case []byte:
+		return 11 + len(v)
+	case time.Time:
+		return 14
+	default:
+		return 10
+	}
+}
@@ -0,0 +1,80 @@
+package mysql
+
+import (
+	"database/sql"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// execs records the INSERTs a batch runs, rather than running them.
+type execs struct {
+	queries []string
+	rows    []int
+}
+
+func (e *execs) exec(query string, args ...interface{}) (sql.Result, error) {
+	e.queries = append(e.queries, query)
+	e.rows = append(e.rows, strings.Count(query, "("))
+	return nil, nil
+}
+
+func TestBatchRows(t *testing.T) {
+	var e execs
+	b := newBatch(e.exec, "aps", []string{"apmac", "apname"}, 2, 1<<20)
+	for _, name := range []string{"one", "two", "three", "four", "five"} {
+		if err := b.add([]byte{0, 1, 2, 3, 4, 5}, name); err != nil {
+			t.Fatalf("add: %v", err)
+		}
+	}
+	if err := b.flush(); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+
+	// the column list has brackets too
+	if got, want := e.rows, []int{3, 3, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got rows %v, want %v", got, want)
+	}
+	if want := "INSERT INTO aps(apmac, apname) VALUES (?,?),(?,?)"; e.queries[0] != want {
+		t.Errorf("got %q, want %q", e.queries[0], want)
+	}
+	if b.inserts != 3 {
+		t.Errorf("got %d inserts, want 3", b.inserts)
+	}
+
+	// nothing left, so nothing to run
+	if err := b.flush(); err != nil || len(e.queries) != 3 {
+		t.Errorf("flush again: ran %d, %v", len(e.queries), err)
+	}
+}
+
+func TestBatchPacket(t *testing.T) {
+	var e execs
+	b := newBatch(e.exec, "aps", []string{"apname"}, 1000, packetHeadroom+200)
+	for i := 0; i < 10; i++ {
+		if err := b.add(strings.Repeat("x", 50)); err != nil {
+			t.Fatalf("add: %v", err)
+		}
+	}
+	if err := b.flush(); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if len(e.queries) < 4 {
+		t.Errorf("got %d inserts, want them split to fit the packet", len(e.queries))
+	}
+	var total int
+	for _, rows := range e.rows {
+		total += rows - 1
+	}
+	if total != 10 {
+		t.Errorf("got %d rows, want 10", total)
+	}
+}
+
+func TestBatchPlaceholders(t *testing.T) {
+	columns := make([]string, 12)
+	b := newBatch(nil, "clients", columns, 1000000, 1<<30)
+	if b.maxRows*len(columns) > maxPlaceholders {
+		t.Errorf("%d rows of %d columns is too many placeholders", b.maxRows, len(columns))
+	}
+}
@@ -0,0 +1,3 @@
+-- every row is tagged with the controller it was polled from
+ALTER TABLE clients ADD COLUMN controller TEXT AFTER timestamp;
+ALTER TABLE aps ADD COLUMN controller TEXT AFTER timestamp;
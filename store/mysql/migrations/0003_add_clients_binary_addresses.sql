@@ -0,0 +1,7 @@
+-- MACs become the six bytes they really are, and IPs are stored as INET6_ATON would, so that the tables can be
+-- indexed on them without a prefix length. MySQL commits each schema change as it goes, so every step is a migration
+-- of its own, and one that fails part way is picked up where it left off.
+ALTER TABLE clients
+	ADD COLUMN apmac_bin BINARY(6) AFTER apmac,
+	ADD COLUMN clientip_bin VARBINARY(16) AFTER clientip,
+	ADD COLUMN clientmac_bin BINARY(6) AFTER clientmac;
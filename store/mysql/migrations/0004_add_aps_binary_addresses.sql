@@ -0,0 +1,2 @@
+ALTER TABLE aps
+	ADD COLUMN apmac_bin BINARY(6) AFTER apmac;
@@ -0,0 +1,9 @@
+-- anything that isn't a valid address becomes NULL, rather than garbage: a MAC has to be exactly 12 hex digits, and
+-- INET6_ATON already gives NULL for anything it can't parse
+UPDATE clients SET
+	apmac_bin = IF(apmac REGEXP '^[0-9A-Fa-f]{12}$', UNHEX(apmac), NULL),
+	clientip_bin = INET6_ATON(clientip),
+	clientmac_bin = IF(clientmac REGEXP '^[0-9A-Fa-f]{12}$', UNHEX(clientmac), NULL);
+
+UPDATE aps SET
+	apmac_bin = IF(apmac REGEXP '^[0-9A-Fa-f]{12}$', UNHEX(apmac), NULL);
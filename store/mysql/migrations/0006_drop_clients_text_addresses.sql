@@ -0,0 +1,4 @@
+ALTER TABLE clients
+	DROP COLUMN apmac,
+	DROP COLUMN clientip,
+	DROP COLUMN clientmac;
@@ -0,0 +1,2 @@
+ALTER TABLE aps
+	DROP COLUMN apmac;
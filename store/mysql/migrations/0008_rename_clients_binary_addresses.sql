@@ -0,0 +1,6 @@
+ALTER TABLE clients
+	CHANGE COLUMN apmac_bin apmac BINARY(6),
+	CHANGE COLUMN clientip_bin clientip VARBINARY(16),
+	CHANGE COLUMN clientmac_bin clientmac BINARY(6),
+	ADD INDEX clients_clientmac_timestamp (clientmac, timestamp),
+	ADD INDEX clients_apmac_timestamp (apmac, timestamp);
@@ -0,0 +1,3 @@
+ALTER TABLE aps
+	CHANGE COLUMN apmac_bin apmac BINARY(6),
+	ADD INDEX aps_apmac_timestamp (apmac, timestamp);
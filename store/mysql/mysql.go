@@ -0,0 +1,270 @@
+// Package mysql stores snapshots in a MySQL database.
+package mysql
+
+import (
+	"database/sql"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/go-sql-driver/mysql"
+
+	"github.com/dotwaffle/wifitracker/store"
+	"github.com/dotwaffle/wifitracker/store/migrate"
+)
+
+// the columns rows are written into
+var (
+	clientColumns = []string{"timestamp", "controller", "apmac", "clientip", "clientmac", "clientssid", "clientuser", "clientproto", "clientrssi", "clientsnr", "clientrecv", "clientsent"}
+	apColumns     = []string{"timestamp", "controller", "apmac", "apname", "apchannel24", "apchannel5"}
+)
+
+// DefaultBatchSize is how many rows go into each INSERT if the Options don't say.
+const DefaultBatchSize = 1000
+
+// Options are how the database is set up.
+type Options struct {
+	// AutoMigrate applies any pending migrations when opening the database.
+	AutoMigrate bool
+	// BatchSize is the most rows written by a single INSERT, which are also kept within the server's
+	// max_allowed_packet. DefaultBatchSize is used if it's zero.
+	BatchSize int
+}
+
+// Sink writes snapshots to the clients and aps tables.
+type Sink struct {
+	db        *sql.DB
+	batchSize int
+	maxPacket int
+}
+
+//go:embed migrations/*.sql
+var migrations embed.FS
+
+// Connect opens the database, without touching the schema. Whatever the DSN says, the session works in UTC.
+func Connect(dsn string) (*sql.DB, error) {
+	log.Debug("Database Setup")
+	dsn, err := utcDSN(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open db: %v", err)
+	}
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open db: %v", err)
+	}
+
+	log.Debug("Database Ping")
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("couldn't ping db: %v", err)
+	}
+	return db, nil
+}
+
+// utcDSN sets the session time zone in the DSN to UTC, and has times sent in UTC, as the TIMESTAMP columns would
+// otherwise take the poll times to be in the server's own time zone.
+func utcDSN(dsn string) (string, error) {
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return "", err
+	}
+	cfg.Loc = time.UTC
+	if cfg.Params == nil {
+		cfg.Params = make(map[string]string)
+	}
+	cfg.Params["time_zone"] = "'+00:00'"
+	return cfg.FormatDSN(), nil
+}
+
+// RedactDSN returns the DSN with its password masked, so it can be logged.
+func RedactDSN(dsn string) string {
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return "(unparseable DSN)"
+	}
+	if cfg.Passwd != "" {
+		cfg.Passwd = "xxxxx"
+	}
+	return cfg.FormatDSN()
+}
+
+// Migrator returns what's needed to bring the database schema up to date.
+func Migrator(db *sql.DB) (*migrate.Migrator, error) {
+	schema, err := migrate.Load(migrations, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	return migrate.New(db, schema), nil
+}
+
+// Open connects to the database, making sure the schema is up to date, and migrating it if the options say to.
+func Open(dsn string, opts Options) (*Sink, error) {
+	if opts.BatchSize == 0 {
+		opts.BatchSize = DefaultBatchSize
+	}
+	if opts.BatchSize < 0 {
+		return nil, fmt.Errorf("batch size can't be negative")
+	}
+
+	db, err := Connect(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debug("Database Migration (if needed)")
+	migrator, err := Migrator(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	if _, err := migrator.Ready(opts.AutoMigrate); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	// every INSERT has to fit in a single packet
+	var maxPacket int
+	if err := db.QueryRow("SELECT @@max_allowed_packet").Scan(&maxPacket); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("couldn't find max_allowed_packet: %v", err)
+	}
+	log.WithFields(log.Fields{
+		"batchSize":          opts.BatchSize,
+		"max_allowed_packet": maxPacket,
+	}).Debug("Database Insert Batching")
+
+	return &Sink{
+		db:        db,
+		batchSize: opts.BatchSize,
+		maxPacket: maxPacket,
+	}, nil
+}
+
+// Write inserts a row for every client and AP in the snapshot, all in one transaction, so that a poll is either
+// written in full or not at all. The rows go in as few multi-row INSERTs as the batch size and max_allowed_packet
+// allow.
+func (s *Sink) Write(snapshot *store.Snapshot) error {
+	err := s.write(snapshot)
+	if transient(err) {
+		return store.Transient(err)
+	}
+	return err
+}
+
+// write is Write, without working out whether any error is worth trying again.
+func (s *Sink) write(snapshot *store.Snapshot) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	// does nothing once the transaction has been committed
+	defer tx.Rollback()
+
+	timestamp := snapshot.Time.UTC()
+
+	// insert the client data
+	clients := newBatch(tx.Exec, "clients", clientColumns, s.batchSize, s.maxPacket)
+	for _, data := range snapshot.Clients {
+		if err := clients.add(
+			timestamp,
+			snapshot.Controller,
+			macBytes(data.APMAC),
+			ipBytes(data.IP),
+			macBytes(data.MAC),
+			data.SSID,
+			data.User,
+			data.Proto,
+			data.RSSI,
+			data.SNR,
+			data.BytesRecv,
+			data.BytesSent,
+		); err != nil {
+			return err
+		}
+	}
+	if err := clients.flush(); err != nil {
+		return err
+	}
+
+	// insert the ap data
+	aps := newBatch(tx.Exec, "aps", apColumns, s.batchSize, s.maxPacket)
+	for _, data := range snapshot.APs {
+		if err := aps.add(
+			timestamp,
+			snapshot.Controller,
+			macBytes(data.MAC),
+			data.Name,
+			data.Channel24GHz,
+			data.Channel5GHz,
+		); err != nil {
+			return err
+		}
+	}
+	if err := aps.flush(); err != nil {
+		return err
+	}
+
+	// commit the transaction, writing everything out to the db
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+	log.WithFields(log.Fields{
+		"controller": snapshot.Controller,
+		"inserts":    clients.inserts + aps.inserts,
+	}).Debug("Database inserts committed")
+	return nil
+}
+
+// transientErrors are the MySQL errors down to the state of the server, rather than what was being written.
+var transientErrors = map[uint16]bool{
+	1021: true, // ER_DISK_FULL
+	1040: true, // ER_CON_COUNT_ERROR, too many connections
+	1053: true, // ER_SERVER_SHUTDOWN
+	1114: true, // ER_RECORD_FILE_FULL
+	1205: true, // ER_LOCK_WAIT_TIMEOUT
+	1213: true, // ER_LOCK_DEADLOCK
+	1290: true, // ER_OPTION_PREVENTS_STATEMENT, such as --read-only during a failover
+	1836: true, // ER_READ_ONLY_MODE
+	1927: true, // ER_CONNECTION_KILLED
+}
+
+// transient is whether a write that failed with err might work if tried again.
+func transient(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		return transientErrors[mysqlErr.Number]
+	}
+	return errors.Is(err, mysql.ErrInvalidConn)
+}
+
+// macBytes packs a MAC address, in the hex the decoder produces, into a BINARY(6) column. Anything that isn't a MAC
+// address is stored as NULL.
+func macBytes(mac string) interface{} {
+	b, err := hex.DecodeString(mac)
+	if err != nil || len(b) != 6 {
+		return nil
+	}
+	return b
+}
+
+// ipBytes packs an IP address into a VARBINARY(16) column the same way INET6_ATON does, as four bytes for IPv4 and
+// sixteen for IPv6, so that INET6_NTOA can turn it back into text. Anything that isn't an IP address is stored as NULL.
+func ipBytes(ip string) interface{} {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return nil
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		return []byte(v4)
+	}
+	return []byte(parsed)
+}
+
+// Close closes the database connection.
+func (s *Sink) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,141 @@
+package mysql
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+
+	"github.com/dotwaffle/wifitracker/decoder"
+	"github.com/dotwaffle/wifitracker/store"
+	"github.com/dotwaffle/wifitracker/store/migrate"
+)
+
+// the tests that need a database want one they can create tables in, such as
+// WIFITRACKER_TEST_MYSQL_DSN="user:pass@tcp(localhost:3306)/wifitest"
+const testDSNEnv = "WIFITRACKER_TEST_MYSQL_DSN"
+
+func TestMACBytes(t *testing.T) {
+	for mac, want := range map[string]interface{}{
+		"003a98aabbcc": []byte{0x00, 0x3a, 0x98, 0xaa, 0xbb, 0xcc},
+		"":             nil,
+		"003a98":       nil,
+		"not a mac!!!": nil,
+	} {
+		if got := macBytes(mac); !reflect.DeepEqual(got, want) {
+			t.Errorf("macBytes(%q) = %v, want %v", mac, got, want)
+		}
+	}
+}
+
+func TestIPBytes(t *testing.T) {
+	for ip, want := range map[string]interface{}{
+		"192.0.2.10":  []byte{192, 0, 2, 10},
+		"0.0.0.0":     []byte{0, 0, 0, 0},
+		"2001:db8::1": []byte{0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1},
+		"":            nil,
+		"nonsense":    nil,
+	} {
+		if got := ipBytes(ip); !reflect.DeepEqual(got, want) {
+			t.Errorf("ipBytes(%q) = %v, want %v", ip, got, want)
+		}
+	}
+}
+
+func TestRedactDSN(t *testing.T) {
+	for dsn, want := range map[string]string{
+		"user:hunter2@tcp(db:3306)/wifi?tls=false": "user:xxxxx@tcp(db:3306)/wifi?tls=false",
+		"user@tcp(db:3306)/wifi":                   "user@tcp(db:3306)/wifi",
+		"user:hunter2@tcp(db:3306)wifi":            "(unparseable DSN)",
+	} {
+		if got := RedactDSN(dsn); got != want {
+			t.Errorf("RedactDSN(%q) = %q, want %q", dsn, got, want)
+		}
+	}
+}
+
+func TestUTCDSN(t *testing.T) {
+	for _, dsn := range []string{
+		"user:hunter2@tcp(db:3306)/wifi",
+		"user:hunter2@tcp(db:3306)/wifi?loc=Local&time_zone=%27-05%3A00%27",
+	} {
+		got, err := utcDSN(dsn)
+		if err != nil {
+			t.Fatalf("utcDSN(%q): %v", dsn, err)
+		}
+		cfg, err := mysql.ParseDSN(got)
+		if err != nil {
+			t.Fatalf("ParseDSN(%q): %v", got, err)
+		}
+		if cfg.Loc != time.UTC || cfg.Params["time_zone"] != "'+00:00'" || cfg.Passwd != "hunter2" {
+			t.Errorf("utcDSN(%q) = %q", dsn, got)
+		}
+	}
+	if _, err := utcDSN("user:hunter2@tcp(db:3306)wifi"); err == nil {
+		t.Errorf("utcDSN accepted an unparseable DSN")
+	}
+}
+
+// TestWriteTimeZone writes a poll over a DSN asking for a session that isn't in UTC, and checks the poll's time still
+// comes out as the same instant.
+func TestWriteTimeZone(t *testing.T) {
+	dsn := os.Getenv(testDSNEnv)
+	if dsn == "" {
+		t.Skipf("%s not set, skipping", testDSNEnv)
+	}
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		t.Fatalf("ParseDSN: %v", err)
+	}
+	if cfg.Params == nil {
+		cfg.Params = make(map[string]string)
+	}
+	cfg.Params["time_zone"] = "'-05:00'"
+	dsn = cfg.FormatDSN()
+
+	sink, err := Open(dsn, Options{AutoMigrate: true})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer sink.Close()
+	snapshot := &store.Snapshot{
+		Controller: fmt.Sprintf("test-%d", time.Now().UnixNano()),
+		Time:       time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC),
+		APs:        []decoder.AP{{MAC: "003a98aabbcc", Name: "ap-lobby"}},
+	}
+	if err := sink.Write(snapshot); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	// UNIX_TIMESTAMP undoes whatever the session's time zone did to the value, so check it over the -05:00 session
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+	defer db.Close()
+	var at int64
+	if err := db.QueryRow(
+		"SELECT UNIX_TIMESTAMP(timestamp) FROM aps WHERE controller = ?", snapshot.Controller,
+	).Scan(&at); err != nil {
+		t.Fatalf("QueryRow: %v", err)
+	}
+	if at != snapshot.Time.Unix() {
+		t.Errorf("got %v, want %v", time.Unix(at, 0).UTC(), snapshot.Time)
+	}
+}
+
+func TestMigrations(t *testing.T) {
+	schema, err := migrate.Load(migrations, "migrations")
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	for i, migration := range schema {
+		if migration.Version != i+1 {
+			t.Errorf("%s: version %d, want %d", migration.Name, migration.Version, i+1)
+		}
+	}
+}
@@ -0,0 +1,22 @@
+-- the schema as it was before migrations, so existing databases are simply adopted
+CREATE TABLE IF NOT EXISTS clients (
+	timestamp TIMESTAMPTZ NOT NULL DEFAULT now(),
+	apmac MACADDR,
+	clientip INET,
+	clientmac MACADDR,
+	clientssid TEXT,
+	clientuser TEXT,
+	clientproto INTEGER,
+	clientrssi INTEGER,
+	clientsnr INTEGER,
+	clientrecv BIGINT,
+	clientsent BIGINT
+);
+
+CREATE TABLE IF NOT EXISTS aps (
+	timestamp TIMESTAMPTZ NOT NULL DEFAULT now(),
+	apmac MACADDR,
+	apname TEXT,
+	apchannel24 INTEGER,
+	apchannel5 INTEGER
+);
@@ -0,0 +1,3 @@
+-- every row is tagged with the controller it was polled from
+ALTER TABLE clients ADD COLUMN IF NOT EXISTS controller TEXT;
+ALTER TABLE aps ADD COLUMN IF NOT EXISTS controller TEXT;
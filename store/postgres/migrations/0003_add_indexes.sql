@@ -0,0 +1,4 @@
+-- looking up a client's history, and joining clients to their APs
+CREATE INDEX IF NOT EXISTS clients_clientmac_timestamp ON clients (clientmac, timestamp);
+CREATE INDEX IF NOT EXISTS clients_apmac_timestamp ON clients (apmac, timestamp);
+CREATE INDEX IF NOT EXISTS aps_apmac_timestamp ON aps (apmac, timestamp);
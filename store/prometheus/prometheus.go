@@ -0,0 +1,251 @@
+// Package prometheus turns the latest snapshot from each controller into metrics for Prometheus to scrape.
+//
+// It's a sink like any other, but rather than storing every snapshot it only keeps the latest from each controller,
+// working out the metrics from it whenever it's scraped, as a metrics.Source. Clients are counted by AP, SSID and
+// protocol, and their signal is summarised in a histogram per AP, so the number of series grows with the APs rather
+// than the clients.
+// Counters of the bytes each client has moved can be turned on as well, up to a limit.
+package prometheus
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/dotwaffle/wifitracker/decoder"
+	"github.com/dotwaffle/wifitracker/metrics"
+	"github.com/dotwaffle/wifitracker/store"
+)
+
+// the upper bounds of the signal histograms' buckets
+var (
+	rssiBuckets = []float64{-90, -80, -75, -70, -67, -60, -50}
+	snrBuckets  = []float64{5, 10, 15, 20, 25, 30, 40}
+)
+
+// Options are the settings which decide how many series are served.
+type Options struct {
+	// ClientBytes serves counters of the bytes sent and received by each client.
+	ClientBytes bool
+	// ClientLimit is the most clients of a single controller given byte counters, so a busy network can't swamp
+	// Prometheus. Those over it are counted in wifitracker_client_bytes_dropped instead. Zero is no limit.
+	ClientLimit int
+}
+
+// Sink keeps the latest snapshot from each controller, writing metrics from them whenever it's scraped.
+type Sink struct {
+	mu        sync.Mutex
+	opts      Options
+	snapshots map[string]*store.Snapshot
+}
+
+// New returns a sink with nothing to serve until the first snapshot is written to it.
+func New(opts Options) *Sink {
+	return &Sink{
+		opts:      opts,
+		snapshots: make(map[string]*store.Snapshot),
+	}
+}
+
+// Write replaces the controller's last snapshot.
+func (s *Sink) Write(snapshot *store.Snapshot) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.snapshots[snapshot.Controller] = snapshot
+	return nil
+}
+
+// Close does nothing, as the metrics carry on being served until the HTTP server is shut down.
+func (s *Sink) Close() error {
+	return nil
+}
+
+// SetOptions changes the settings, which take effect from the next scrape.
+func (s *Sink) SetOptions(opts Options) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.opts = opts
+}
+
+// Retain forgets the snapshots of every controller but those named, so those no longer polled stop being served.
+func (s *Sink) Retain(controllers []string) {
+	keep := make(map[string]bool)
+	for _, name := range controllers {
+		keep[name] = true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name := range s.snapshots {
+		if !keep[name] {
+			delete(s.snapshots, name)
+		}
+	}
+}
+
+// WriteMetrics writes every metric family, each with the samples from every controller.
+func (s *Sink) WriteMetrics(w *metrics.Writer) {
+	s.mu.Lock()
+	opts := s.opts
+	snapshots := make([]*store.Snapshot, 0, len(s.snapshots))
+	for _, snapshot := range s.snapshots {
+		snapshots = append(snapshots, snapshot)
+	}
+	s.mu.Unlock()
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Controller < snapshots[j].Controller
+	})
+
+	w.Family("wifitracker_snapshot_timestamp_seconds", "gauge", "When the controller was last polled.")
+	for _, s := range snapshots {
+		w.Sample("wifitracker_snapshot_timestamp_seconds", controllerLabels(s), float64(s.Time.UnixNano())/1e9)
+	}
+
+	w.Family("wifitracker_ap_clients", "gauge", "Clients associated to the AP.")
+	for _, s := range snapshots {
+		counts := make(map[string]int)
+		for _, c := range s.Clients {
+			counts[c.APMAC]++
+		}
+		for _, ap := range sortedAPs(s) {
+			w.Sample("wifitracker_ap_clients", apLabels(s, ap), float64(counts[ap.MAC]))
+		}
+	}
+
+	w.Family("wifitracker_ssid_clients", "gauge", "Clients associated to the SSID.")
+	for _, s := range snapshots {
+		counts := countClients(s.Clients, func(c *decoder.Client) string { return c.SSID })
+		for _, ssid := range sortedKeys(counts) {
+			w.Sample("wifitracker_ssid_clients", append(controllerLabels(s), metrics.Label{Name: "ssid", Value: ssid}), float64(counts[ssid]))
+		}
+	}
+
+	w.Family("wifitracker_protocol_clients", "gauge", "Clients associated using the 802.11 protocol.")
+	for _, s := range snapshots {
+		counts := countClients(s.Clients, (*decoder.Client).Protocol)
+		for _, proto := range sortedKeys(counts) {
+			w.Sample("wifitracker_protocol_clients", append(controllerLabels(s), metrics.Label{Name: "protocol", Value: proto}), float64(counts[proto]))
+		}
+	}
+
+	w.Family("wifitracker_ap_channel", "gauge", "The channel the AP's radio is on in the band.")
+	for _, s := range snapshots {
+		for _, ap := range sortedAPs(s) {
+			// a radio that's switched off has no channel
+			if ap.Channel24GHz != 0 {
+				w.Sample("wifitracker_ap_channel", append(apLabels(s, ap), metrics.Label{Name: "band", Value: "2.4GHz"}), float64(ap.Channel24GHz))
+			}
+			if ap.Channel5GHz != 0 {
+				w.Sample("wifitracker_ap_channel", append(apLabels(s, ap), metrics.Label{Name: "band", Value: "5GHz"}), float64(ap.Channel5GHz))
+			}
+		}
+	}
+
+	rssi := make([]map[string]*metrics.Histogram, len(snapshots))
+	snr := make([]map[string]*metrics.Histogram, len(snapshots))
+	for i, s := range snapshots {
+		rssi[i] = make(map[string]*metrics.Histogram)
+		snr[i] = make(map[string]*metrics.Histogram)
+		for _, ap := range s.APs {
+			rssi[i][ap.MAC] = metrics.NewHistogram(rssiBuckets)
+			snr[i][ap.MAC] = metrics.NewHistogram(snrBuckets)
+		}
+		for _, c := range s.Clients {
+			// clients of an AP that's missing from the poll have nowhere to go
+			if _, ok := rssi[i][c.APMAC]; !ok {
+				continue
+			}
+			rssi[i][c.APMAC].Observe(float64(c.RSSI))
+			snr[i][c.APMAC].Observe(float64(c.SNR))
+		}
+	}
+	w.Family("wifitracker_client_rssi_dbm", "histogram", "The signal strength of the AP's clients.")
+	for i, s := range snapshots {
+		for _, ap := range sortedAPs(s) {
+			w.Histogram("wifitracker_client_rssi_dbm", apLabels(s, ap), rssi[i][ap.MAC])
+		}
+	}
+	w.Family("wifitracker_client_snr_db", "histogram", "The signal to noise ratio of the AP's clients.")
+	for i, s := range snapshots {
+		for _, ap := range sortedAPs(s) {
+			w.Histogram("wifitracker_client_snr_db", apLabels(s, ap), snr[i][ap.MAC])
+		}
+	}
+
+	if opts.ClientBytes {
+		writeClientBytes(w, snapshots, opts.ClientLimit)
+	}
+}
+
+// writeClientBytes writes the byte counters of each client, up to limit clients of each controller.
+func writeClientBytes(w *metrics.Writer, snapshots []*store.Snapshot, limit int) {
+	clients := make([][]decoder.Client, len(snapshots))
+	dropped := make([]int, len(snapshots))
+	for i, s := range snapshots {
+		clients[i] = append([]decoder.Client(nil), s.Clients...)
+		sort.Slice(clients[i], func(a, b int) bool {
+			return clients[i][a].MAC < clients[i][b].MAC
+		})
+		if limit > 0 && len(clients[i]) > limit {
+			dropped[i] = len(clients[i]) - limit
+			clients[i] = clients[i][:limit]
+		}
+	}
+
+	w.Family("wifitracker_client_received_bytes_total", "counter", "Bytes received from the client.")
+	for i, s := range snapshots {
+		for _, c := range clients[i] {
+			w.Sample("wifitracker_client_received_bytes_total", clientLabels(s, &c), float64(c.BytesRecv))
+		}
+	}
+	w.Family("wifitracker_client_sent_bytes_total", "counter", "Bytes sent to the client.")
+	for i, s := range snapshots {
+		for _, c := range clients[i] {
+			w.Sample("wifitracker_client_sent_bytes_total", clientLabels(s, &c), float64(c.BytesSent))
+		}
+	}
+	w.Family("wifitracker_client_bytes_dropped", "gauge", "Clients left without byte counters, being over the limit.")
+	for i, s := range snapshots {
+		w.Sample("wifitracker_client_bytes_dropped", controllerLabels(s), float64(dropped[i]))
+	}
+}
+
+func controllerLabels(s *store.Snapshot) []metrics.Label {
+	return []metrics.Label{{Name: "controller", Value: s.Controller}}
+}
+
+func apLabels(s *store.Snapshot, ap *decoder.AP) []metrics.Label {
+	return []metrics.Label{{Name: "controller", Value: s.Controller}, {Name: "ap", Value: ap.Name}, {Name: "apmac", Value: ap.MAC}}
+}
+
+func clientLabels(s *store.Snapshot, c *decoder.Client) []metrics.Label {
+	return []metrics.Label{{Name: "controller", Value: s.Controller}, {Name: "mac", Value: c.MAC}}
+}
+
+// sortedAPs returns the snapshot's APs in order of their MAC addresses, so each scrape comes out the same.
+func sortedAPs(s *store.Snapshot) []*decoder.AP {
+	aps := make([]*decoder.AP, len(s.APs))
+	for i := range s.APs {
+		aps[i] = &s.APs[i]
+	}
+	sort.Slice(aps, func(i, j int) bool {
+		return aps[i].MAC < aps[j].MAC
+	})
+	return aps
+}
+
+// countClients counts the clients by the key that's given for each of them.
+func countClients(clients []decoder.Client, key func(*decoder.Client) string) map[string]int {
+	counts := make(map[string]int)
+	for i := range clients {
+		counts[key(&clients[i])]++
+	}
+	return counts
+}
+
+func sortedKeys(counts map[string]int) []string {
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
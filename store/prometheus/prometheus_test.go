@@ -0,0 +1,129 @@
+package prometheus
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dotwaffle/wifitracker/decoder"
+	"github.com/dotwaffle/wifitracker/metrics"
+	"github.com/dotwaffle/wifitracker/store"
+)
+
+// scrape returns the lines served by the sink.
+func scrape(t *testing.T, s *Sink) []string {
+	t.Helper()
+	var buf bytes.Buffer
+	w := metrics.NewWriter(&buf)
+	s.WriteMetrics(w)
+	w.Flush()
+	return strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+}
+
+// has reports whether every line wanted was served.
+func has(t *testing.T, lines []string, want ...string) {
+	t.Helper()
+	served := make(map[string]bool)
+	for _, line := range lines {
+		served[line] = true
+	}
+	for _, line := range want {
+		if !served[line] {
+			t.Errorf("%s not served in:\n%s", line, strings.Join(lines, "\n"))
+		}
+	}
+}
+
+func snapshot() *store.Snapshot {
+	return &store.Snapshot{
+		Controller: "wlc1",
+		Time:       time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC),
+		Clients: []decoder.Client{
+			{APMAC: "003a98aabbcc", MAC: "001122334455", SSID: "eduroam", Proto: 7, RSSI: -61, SNR: 32, BytesRecv: 100, BytesSent: 200},
+			{APMAC: "003a98aabbcc", MAC: "001122334466", SSID: "guest", Proto: 3, RSSI: -72, SNR: 18, BytesRecv: 300, BytesSent: 400},
+			{APMAC: "003a98ddeeff", MAC: "001122334477", SSID: "eduroam", Proto: 9, RSSI: -85, SNR: 4},
+		},
+		APs: []decoder.AP{
+			{MAC: "003a98aabbcc", Name: "ap-lobby", Channel24GHz: 6, Channel5GHz: 36},
+			{MAC: "003a98ddeeff", Name: `ap-"cellar"`, Channel24GHz: 11},
+			{MAC: "003a98000000", Name: "ap-empty", Channel5GHz: 149},
+		},
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	s := New(Options{})
+	if err := s.Write(snapshot()); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	lines := scrape(t, s)
+	has(t, lines,
+		"# TYPE wifitracker_ap_clients gauge",
+		`wifitracker_snapshot_timestamp_seconds{controller="wlc1"} 1.4963184e+09`,
+		`wifitracker_ap_clients{controller="wlc1",ap="ap-lobby",apmac="003a98aabbcc"} 2`,
+		`wifitracker_ap_clients{controller="wlc1",ap="ap-\"cellar\"",apmac="003a98ddeeff"} 1`,
+		`wifitracker_ap_clients{controller="wlc1",ap="ap-empty",apmac="003a98000000"} 0`,
+		`wifitracker_ssid_clients{controller="wlc1",ssid="eduroam"} 2`,
+		`wifitracker_ssid_clients{controller="wlc1",ssid="guest"} 1`,
+		`wifitracker_protocol_clients{controller="wlc1",protocol="dot11n5"} 1`,
+		`wifitracker_protocol_clients{controller="wlc1",protocol="dot11g"} 1`,
+		`wifitracker_protocol_clients{controller="wlc1",protocol="9"} 1`,
+		`wifitracker_ap_channel{controller="wlc1",ap="ap-lobby",apmac="003a98aabbcc",band="2.4GHz"} 6`,
+		`wifitracker_ap_channel{controller="wlc1",ap="ap-lobby",apmac="003a98aabbcc",band="5GHz"} 36`,
+		"# TYPE wifitracker_client_rssi_dbm histogram",
+		`wifitracker_client_rssi_dbm_bucket{controller="wlc1",ap="ap-lobby",apmac="003a98aabbcc",le="-70"} 1`,
+		`wifitracker_client_rssi_dbm_bucket{controller="wlc1",ap="ap-lobby",apmac="003a98aabbcc",le="-60"} 2`,
+		`wifitracker_client_rssi_dbm_bucket{controller="wlc1",ap="ap-lobby",apmac="003a98aabbcc",le="+Inf"} 2`,
+		`wifitracker_client_rssi_dbm_sum{controller="wlc1",ap="ap-lobby",apmac="003a98aabbcc"} -133`,
+		`wifitracker_client_rssi_dbm_count{controller="wlc1",ap="ap-empty",apmac="003a98000000"} 0`,
+		`wifitracker_client_snr_db_bucket{controller="wlc1",ap="ap-\"cellar\"",apmac="003a98ddeeff",le="5"} 1`,
+	)
+	for _, line := range lines {
+		if strings.Contains(line, `band="5GHz"`) && strings.Contains(line, "cellar") {
+			t.Errorf("switched off radio served: %s", line)
+		}
+		if strings.Contains(line, "bytes") {
+			t.Errorf("byte counters served without being turned on: %s", line)
+		}
+	}
+}
+
+func TestClientBytes(t *testing.T) {
+	s := New(Options{ClientBytes: true, ClientLimit: 2})
+	s.Write(snapshot())
+	has(t, scrape(t, s),
+		"# TYPE wifitracker_client_received_bytes_total counter",
+		`wifitracker_client_received_bytes_total{controller="wlc1",mac="001122334455"} 100`,
+		`wifitracker_client_sent_bytes_total{controller="wlc1",mac="001122334466"} 400`,
+		`wifitracker_client_bytes_dropped{controller="wlc1"} 1`,
+	)
+	for _, line := range scrape(t, s) {
+		if strings.Contains(line, "001122334477") {
+			t.Errorf("client over the limit served: %s", line)
+		}
+	}
+
+	s.SetOptions(Options{ClientBytes: true})
+	has(t, scrape(t, s),
+		`wifitracker_client_received_bytes_total{controller="wlc1",mac="001122334477"} 0`,
+		`wifitracker_client_bytes_dropped{controller="wlc1"} 0`,
+	)
+}
+
+func TestRetain(t *testing.T) {
+	s := New(Options{})
+	s.Write(snapshot())
+	wlc2 := snapshot()
+	wlc2.Controller = "wlc2"
+	s.Write(wlc2)
+
+	s.Retain([]string{"wlc2", "wlc3"})
+	lines := scrape(t, s)
+	has(t, lines, `wifitracker_snapshot_timestamp_seconds{controller="wlc2"} 1.4963184e+09`)
+	for _, line := range lines {
+		if strings.Contains(line, `"wlc1"`) {
+			t.Errorf("forgotten controller served: %s", line)
+		}
+	}
+}
@@ -0,0 +1,475 @@
+// Package spool keeps snapshots on disk while a storage backend can't be written to, and writes them to it, oldest
+// first, once it's back.
+//
+// Each spooled snapshot is a file of its own in the spool directory, named after its place in the queue, so the
+// queue survives a restart and is only ever appended to at one end and drained from the other. Only snapshots that
+// failed to be written for a reason that might go away, such as the database being down, are spooled. A spooled
+// snapshot that the backend refuses outright is moved into the rejected directory, rather than holding up the rest.
+package spool
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/dotwaffle/wifitracker/store"
+)
+
+// how spooled snapshots are named, by their place in the queue
+const (
+	entryFormat = "%020d.json"
+	entrySuffix = ".json"
+	tempSuffix  = ".tmp"
+	rejectedDir = "rejected"
+)
+
+// how long to wait before writing out the queue again after the backend has failed, doubling each time it fails again
+var (
+	minRetry = 1 * time.Second
+	maxRetry = 5 * time.Minute
+)
+
+// Options limit how much is kept on disk.
+type Options struct {
+	// MaxSize is the most bytes of snapshots kept, beyond which the oldest are dropped, or no limit if zero.
+	MaxSize int64
+	// MaxAge is how long a snapshot is kept before it's dropped, or forever if zero.
+	MaxAge time.Duration
+}
+
+// an entry is a snapshot waiting in the spool.
+type entry struct {
+	seq     uint64
+	size    int64
+	spooled time.Time
+}
+
+// Spool writes snapshots to another Sink, spooling them to disk whenever that fails.
+type Spool struct {
+	mu   sync.Mutex
+	dir  string
+	next store.Sink
+	opts Options
+	log  *log.Entry
+
+	// oldest first
+	entries []entry
+	size    int64
+	seq     uint64
+
+	// wake starts the drainer writing out the queue, failed tells it a write has just failed, so to wait a while first,
+	// and done is closed once it has stopped for good.
+	wake   chan struct{}
+	failed chan struct{}
+	done   chan struct{}
+	closed bool
+}
+
+// Open returns a Spool in front of next, keeping its queue in dir, which is created if needed. Anything already
+// queued in dir is written to next in the background, ahead of any new snapshots.
+func Open(dir string, next store.Sink, opts Options) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &Spool{
+		dir:  dir,
+		next: next,
+		opts: opts,
+		log: log.WithFields(log.Fields{
+			"spool": dir,
+		}),
+		wake:   make(chan struct{}, 1),
+		failed: make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	go s.drainer()
+	if len(s.entries) > 0 {
+		s.log.WithFields(log.Fields{
+			"backlog": len(s.entries),
+			"bytes":   s.size,
+		}).Info("Found spooled snapshots")
+		s.mu.Lock()
+		s.wakeDrainer()
+		s.mu.Unlock()
+	}
+	return s, nil
+}
+
+// load finds the snapshots already in the queue, tidying up any half-written ones.
+func (s *Spool) load() error {
+	files, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		name := file.Name()
+		if strings.HasSuffix(name, tempSuffix) {
+			os.Remove(filepath.Join(s.dir, name))
+			continue
+		}
+		if file.IsDir() || !strings.HasSuffix(name, entrySuffix) {
+			continue
+		}
+		seq, ok := parseSeq(name)
+		if !ok {
+			continue
+		}
+		info, err := file.Info()
+		if err != nil {
+			return err
+		}
+		s.entries = append(s.entries, entry{seq: seq, size: info.Size(), spooled: info.ModTime()})
+		s.size += info.Size()
+		if seq > s.seq {
+			s.seq = seq
+		}
+	}
+	sort.Slice(s.entries, func(i, j int) bool { return s.entries[i].seq < s.entries[j].seq })
+
+	// rejected snapshots have left the queue, but their places in it mustn't be used again
+	rejected, err := os.ReadDir(filepath.Join(s.dir, rejectedDir))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, file := range rejected {
+		if seq, ok := parseSeq(file.Name()); ok && seq > s.seq {
+			s.seq = seq
+		}
+	}
+	return nil
+}
+
+// parseSeq finds a spooled snapshot's place in the queue from its file name.
+func parseSeq(name string) (uint64, bool) {
+	if !strings.HasSuffix(name, entrySuffix) {
+		return 0, false
+	}
+	seq, err := strconv.ParseUint(strings.TrimSuffix(name, entrySuffix), 10, 64)
+	return seq, err == nil
+}
+
+// Write writes the snapshot, unless there are snapshots spooled ahead of it, in which case it joins the end of the
+// queue, and the queue is written out in the background. If the write fails in a way that might go away by itself,
+// the snapshot is spooled too. An error is returned if the backend refused the snapshot outright, or spooling failed.
+func (s *Spool) Write(snapshot *store.Snapshot) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expire(time.Now())
+	if len(s.entries) > 0 {
+		// written now, it would overtake everything waiting
+		if err := s.append(snapshot); err != nil {
+			return fmt.Errorf("couldn't spool snapshot: %v", err)
+		}
+		s.wakeDrainer()
+		return nil
+	}
+
+	err := s.next.Write(snapshot)
+	if err == nil || !store.IsTransient(err) {
+		return err
+	}
+	if spoolErr := s.append(snapshot); spoolErr != nil {
+		return fmt.Errorf("%v, and couldn't spool it: %v", err, spoolErr)
+	}
+	select {
+	case s.failed <- struct{}{}:
+	default:
+	}
+	s.log.WithFields(log.Fields{
+		"controller": snapshot.Controller,
+		"backlog":    len(s.entries),
+		"bytes":      s.size,
+		"err":        err,
+	}).Warn("Storage write failed, spooled snapshot")
+	return nil
+}
+
+// SetOptions changes how much the spool keeps, from the next snapshot on.
+func (s *Spool) SetOptions(opts Options) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.opts = opts
+}
+
+// Len returns how many snapshots are waiting in the spool.
+func (s *Spool) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.entries)
+}
+
+// Close stops writing out the queue, once any snapshot being written has been, and closes the Sink behind the spool.
+// Anything still spooled stays on disk for next time.
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.wake)
+	}
+	s.mu.Unlock()
+	<-s.done
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.next.Close()
+}
+
+// wakeDrainer gets the queue written out, if it isn't already being. The spool must be locked.
+func (s *Spool) wakeDrainer() {
+	if s.closed {
+		return
+	}
+	select {
+	case s.wake <- struct{}{}:
+	default:
+		// already woken, and yet to start
+	}
+}
+
+// drainer writes out the queue whenever it's woken, until the spool is closed. Once a write has failed, it waits before
+// trying again, for longer each time it fails, rather than trying again with every snapshot that joins the queue.
+func (s *Spool) drainer() {
+	defer close(s.done)
+	var (
+		wait  time.Duration
+		timer *time.Timer
+		retry <-chan time.Time
+	)
+	backOff := func() {
+		if wait = 2 * wait; wait < minRetry {
+			wait = minRetry
+		} else if wait > maxRetry {
+			wait = maxRetry
+		}
+		timer = time.NewTimer(wait)
+		retry = timer.C
+	}
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+
+	for {
+		select {
+		case _, ok := <-s.wake:
+			if !ok {
+				return
+			}
+			if retry != nil {
+				// the backend is given its time to come back first
+				continue
+			}
+		case <-s.failed:
+			if retry == nil {
+				backOff()
+			}
+			continue
+		case <-retry:
+			retry = nil
+		}
+		if s.drain() {
+			wait = 0
+		} else {
+			backOff()
+		}
+	}
+}
+
+// drain writes spooled snapshots, oldest first, until there are none left, or one fails in a way that might go away
+// by itself, in which case it returns false. The spool is only locked between snapshots, so that Write isn't held up
+// by the backlog.
+func (s *Spool) drain() bool {
+	var drained int
+	defer func() {
+		if drained > 0 {
+			s.log.WithFields(log.Fields{
+				"snapshots": drained,
+			}).Info("Spooled snapshots written")
+		}
+	}()
+
+	for {
+		s.mu.Lock()
+		s.expire(time.Now())
+		if s.closed || len(s.entries) == 0 {
+			s.mu.Unlock()
+			return true
+		}
+		oldest := s.entries[0]
+		s.mu.Unlock()
+
+		snapshot, readErr := s.read(oldest)
+		var err error
+		if readErr == nil {
+			err = s.next.Write(snapshot)
+		}
+
+		s.mu.Lock()
+		switch {
+		case len(s.entries) == 0 || s.entries[0].seq != oldest.seq:
+			// dropped for being too old, or the spool being full, while it was being written
+		case readErr != nil:
+			// it'll never be any more readable than it is now
+			s.log.WithFields(log.Fields{
+				"file": s.path(oldest.seq),
+				"err":  readErr,
+			}).Warn("Dropping unreadable spooled snapshot")
+			s.remove()
+		case err == nil:
+			s.remove()
+			drained++
+		case store.IsTransient(err):
+			s.log.WithFields(log.Fields{
+				"backlog": len(s.entries),
+				"bytes":   s.size,
+				"err":     err,
+			}).Warn("Storage write failed, keeping spooled snapshots")
+			s.mu.Unlock()
+			return false
+		default:
+			s.reject(err)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// expire drops spooled snapshots older than MaxAge.
+func (s *Spool) expire(now time.Time) {
+	if s.opts.MaxAge <= 0 {
+		return
+	}
+	var dropped int
+	for len(s.entries) > 0 && now.Sub(s.entries[0].spooled) > s.opts.MaxAge {
+		s.remove()
+		dropped++
+	}
+	if dropped > 0 {
+		s.log.WithFields(log.Fields{
+			"snapshots": dropped,
+			"maxAge":    s.opts.MaxAge,
+		}).Warn("Dropped spooled snapshots that were too old")
+	}
+}
+
+// append adds the snapshot to the end of the queue, dropping the oldest snapshots if the spool is too big.
+func (s *Spool) append(snapshot *store.Snapshot) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	// written to one side and renamed into place, so that a crash never leaves half a snapshot in the queue
+	seq := s.seq + 1
+	temp := s.path(seq) + tempSuffix
+	f, err := os.Create(temp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(temp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(temp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(temp)
+		return err
+	}
+	if err := os.Rename(temp, s.path(seq)); err != nil {
+		os.Remove(temp)
+		return err
+	}
+
+	s.seq = seq
+	s.entries = append(s.entries, entry{seq: seq, size: int64(len(data)), spooled: time.Now()})
+	s.size += int64(len(data))
+
+	var dropped int
+	for s.opts.MaxSize > 0 && s.size > s.opts.MaxSize && len(s.entries) > 1 {
+		s.remove()
+		dropped++
+	}
+	if dropped > 0 {
+		s.log.WithFields(log.Fields{
+			"snapshots": dropped,
+			"maxSize":   s.opts.MaxSize,
+		}).Warn("Spool full, dropped the oldest snapshots")
+	}
+	return nil
+}
+
+// reject moves the oldest snapshot out of the queue and into the rejected directory, as the backend would only refuse
+// it again, but someone might want to know why.
+func (s *Spool) reject(err error) {
+	oldest := s.entries[0]
+	dir := filepath.Join(s.dir, rejectedDir)
+	moved := filepath.Join(dir, filepath.Base(s.path(oldest.seq)))
+	moveErr := os.MkdirAll(dir, 0755)
+	if moveErr == nil {
+		moveErr = os.Rename(s.path(oldest.seq), moved)
+	}
+	if moveErr != nil {
+		s.log.WithFields(log.Fields{
+			"file":    s.path(oldest.seq),
+			"err":     err,
+			"moveErr": moveErr,
+		}).Warn("Storage rejected spooled snapshot, and it couldn't be moved aside, so dropping it")
+		s.remove()
+		return
+	}
+
+	s.entries = s.entries[1:]
+	s.size -= oldest.size
+	s.log.WithFields(log.Fields{
+		"file": moved,
+		"err":  err,
+	}).Warn("Storage rejected spooled snapshot, moved it aside")
+}
+
+// read loads a spooled snapshot.
+func (s *Spool) read(e entry) (*store.Snapshot, error) {
+	data, err := os.ReadFile(s.path(e.seq))
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &store.Snapshot{}
+	if err := json.Unmarshal(data, snapshot); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// remove takes the oldest snapshot off the queue.
+func (s *Spool) remove() {
+	oldest := s.entries[0]
+	if err := os.Remove(s.path(oldest.seq)); err != nil && !os.IsNotExist(err) {
+		s.log.WithFields(log.Fields{
+			"file": s.path(oldest.seq),
+			"err":  err,
+		}).Warn("Couldn't remove spooled snapshot")
+	}
+	s.entries = s.entries[1:]
+	s.size -= oldest.size
+}
+
+// path is where a spooled snapshot lives.
+func (s *Spool) path(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf(entryFormat, seq))
+}
@@ -0,0 +1,233 @@
+package spool
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dotwaffle/wifitracker/store"
+)
+
+// flaky is a Sink that can be told to fail, remembering which controllers' snapshots it was given. Snapshots from the
+// refused controller are never written.
+type flaky struct {
+	mu      sync.Mutex
+	down    bool
+	refused string
+	written []string
+	closed  bool
+}
+
+func (f *flaky) Write(snapshot *store.Snapshot) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.down {
+		return store.Transient(errors.New("database is down"))
+	}
+	if snapshot.Controller == f.refused {
+		return errors.New("data too long for column")
+	}
+	f.written = append(f.written, snapshot.Controller)
+	return nil
+}
+
+func (f *flaky) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	return nil
+}
+
+func (f *flaky) setDown(down bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.down = down
+}
+
+func (f *flaky) got() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.written...)
+}
+
+// drained waits for the spool to write out its queue in the background.
+func drained(t *testing.T, s *Spool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); s.Len() > 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("still %d spooled", s.Len())
+		}
+	}
+}
+
+// openSpool opens a spool that soon tries again after a failed write, closing it once the test is done.
+func openSpool(t *testing.T, dir string, next store.Sink, opts Options) *Spool {
+	t.Helper()
+	min, max := minRetry, maxRetry
+	minRetry, maxRetry = time.Millisecond, 4*time.Millisecond
+	t.Cleanup(func() { minRetry, maxRetry = min, max })
+	s, err := Open(dir, next, opts)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func snapshot(controller string) *store.Snapshot {
+	return &store.Snapshot{Controller: controller, Time: time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+func TestSpoolDrainsInOrder(t *testing.T) {
+	dir := t.TempDir()
+	next := &flaky{}
+	s := openSpool(t, dir, next, Options{})
+
+	if err := s.Write(snapshot("one")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	next.setDown(true)
+	for _, name := range []string{"two", "three"} {
+		if err := s.Write(snapshot(name)); err != nil {
+			t.Fatalf("Write while down: %v", err)
+		}
+	}
+	if s.Len() != 2 {
+		t.Errorf("got %d spooled, want 2", s.Len())
+	}
+
+	// restarting keeps the backlog
+	s.Close()
+	s = openSpool(t, dir, next, Options{})
+	if s.Len() != 2 {
+		t.Errorf("after reopening: got %d spooled, want 2", s.Len())
+	}
+
+	// which is written out once the backend is back, without waiting for another snapshot
+	next.setDown(false)
+	drained(t, s)
+	if err := s.Write(snapshot("four")); err != nil {
+		t.Fatalf("Write once back: %v", err)
+	}
+	if want := []string{"one", "two", "three", "four"}; !reflect.DeepEqual(next.got(), want) {
+		t.Errorf("written %v, want %v", next.got(), want)
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Errorf("got %d files left in the spool", len(files))
+	}
+
+	s.Close()
+	if !next.closed {
+		t.Errorf("Close didn't close the sink behind it")
+	}
+}
+
+func TestSpoolMaxSize(t *testing.T) {
+	next := &flaky{down: true}
+	s := openSpool(t, t.TempDir(), next, Options{})
+	if err := s.Write(snapshot("one")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	// room for two snapshots, but not three, so each one joining the end of the queue pushes the oldest out
+	s.mu.Lock()
+	s.opts.MaxSize = s.size*2 + s.size/2
+	s.mu.Unlock()
+	for _, name := range []string{"two", "three", "four"} {
+		if err := s.Write(snapshot(name)); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	if s.Len() != 2 {
+		t.Errorf("got %d spooled, want 2", s.Len())
+	}
+	next.setDown(false)
+	drained(t, s)
+	if want := []string{"three", "four"}; !reflect.DeepEqual(next.got(), want) {
+		t.Errorf("written %v, want %v", next.got(), want)
+	}
+}
+
+func TestSpoolMaxAge(t *testing.T) {
+	next := &flaky{down: true}
+	s := openSpool(t, t.TempDir(), next, Options{MaxAge: time.Hour})
+	for _, name := range []string{"one", "two"} {
+		if err := s.Write(snapshot(name)); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	// the first was spooled a long time ago, so it's dropped rather than written
+	s.mu.Lock()
+	s.entries[0].spooled = time.Now().Add(-2 * time.Hour)
+	s.mu.Unlock()
+	next.setDown(false)
+	drained(t, s)
+	if want := []string{"two"}; !reflect.DeepEqual(next.got(), want) {
+		t.Errorf("written %v, want %v", next.got(), want)
+	}
+}
+
+func TestSpoolUnreadable(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "00000000000000000001.json"), []byte("{not json"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "00000000000000000002.json.tmp"), []byte("{half"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	next := &flaky{}
+	s := openSpool(t, dir, next, Options{})
+	if err := s.Write(snapshot("one")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	drained(t, s)
+	if want := []string{"one"}; !reflect.DeepEqual(next.got(), want) {
+		t.Errorf("written %v, want %v", next.got(), want)
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Errorf("got %d files left in the spool", len(files))
+	}
+}
+
+func TestSpoolRejected(t *testing.T) {
+	dir := t.TempDir()
+	next := &flaky{refused: "bad"}
+	s := openSpool(t, dir, next, Options{})
+
+	// refused outright, there's no point spooling it
+	if err := s.Write(snapshot("bad")); err == nil {
+		t.Errorf("Write of a refused snapshot didn't fail")
+	}
+	if s.Len() != 0 {
+		t.Errorf("got %d spooled, want none", s.Len())
+	}
+
+	// but once it's spooled, it mustn't hold up the rest
+	next.setDown(true)
+	for _, name := range []string{"one", "bad", "two"} {
+		if err := s.Write(snapshot(name)); err != nil {
+			t.Fatalf("Write while down: %v", err)
+		}
+	}
+	next.setDown(false)
+	drained(t, s)
+	if want := []string{"one", "two"}; !reflect.DeepEqual(next.got(), want) {
+		t.Errorf("written %v, want %v", next.got(), want)
+	}
+	rejected, _ := os.ReadDir(filepath.Join(dir, rejectedDir))
+	if len(rejected) != 1 || rejected[0].Name() != "00000000000000000002.json" {
+		t.Errorf("got %v rejected, want the second snapshot spooled", rejected)
+	}
+	s.Close()
+
+	// which keeps its place in the queue from being used again
+	s = openSpool(t, dir, next, Options{})
+	if s.seq != 2 {
+		t.Errorf("reopened at %d, want 2", s.seq)
+	}
+}
@@ -0,0 +1,24 @@
+-- the schema as it was before migrations, so existing databases are simply adopted
+CREATE TABLE IF NOT EXISTS clients (
+	id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+	timestamp TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	apmac TEXT,
+	clientip TEXT,
+	clientmac TEXT,
+	clientssid TEXT,
+	clientuser TEXT,
+	clientproto INTEGER,
+	clientrssi INTEGER,
+	clientsnr INTEGER,
+	clientrecv INTEGER,
+	clientsent INTEGER
+);
+
+CREATE TABLE IF NOT EXISTS aps (
+	id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+	timestamp TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	apmac TEXT,
+	apname TEXT,
+	apchannel24 INTEGER,
+	apchannel5 INTEGER
+);
@@ -0,0 +1,180 @@
+// Package sqlite stores snapshots in an SQLite database file, for when running a database server is overkill.
+//
+// It uses a pure Go SQLite, so needs no cgo, and runs the database in WAL mode so that it can be read while the
+// collectors are writing to it.
+package sqlite
+
+import (
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+
+	log "github.com/Sirupsen/logrus"
+	_ "modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+
+	"github.com/dotwaffle/wifitracker/store"
+	"github.com/dotwaffle/wifitracker/store/migrate"
+)
+
+// how rows are written into the database
+const (
+	sqlInsertClient = "INSERT INTO clients(timestamp, controller, apmac, clientip, clientmac, clientssid, clientuser, clientproto, clientrssi, clientsnr, clientrecv, clientsent) VALUES (?,?,?,?,?,?,?,?,?,?,?,?)"
+	sqlInsertAP     = "INSERT INTO aps(timestamp, controller, apmac, apname, apchannel24, apchannel5) VALUES (?,?,?,?,?,?)"
+)
+
+// TimeFormat is how timestamps are stored, which is the same as CURRENT_TIMESTAMP so they sort and compare properly.
+const TimeFormat = "2006-01-02 15:04:05"
+
+// the settings every connection needs
+var pragmas = []string{
+	// readers don't block the writer, and the writer doesn't block readers
+	"PRAGMA journal_mode = WAL",
+	// WAL is safe against corruption with NORMAL, it just might lose the last poll on power loss
+	"PRAGMA synchronous = NORMAL",
+	// wait rather than fail if something else has the database locked
+	"PRAGMA busy_timeout = 5000",
+}
+
+// Sink writes snapshots to the clients and aps tables.
+type Sink struct {
+	db *sql.DB
+}
+
+//go:embed migrations/*.sql
+var migrations embed.FS
+
+// Connect opens the database file, creating it if needed, without touching the schema.
+func Connect(path string) (*sql.DB, error) {
+	log.Debug("Database Setup")
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open db: %v", err)
+	}
+	// SQLite only ever has one writer, and the pragmas only apply to the connection they're run on
+	db.SetMaxOpenConns(1)
+
+	for _, pragma := range pragmas {
+		if _, err := db.Exec(pragma); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("couldn't set %q: %v", pragma, err)
+		}
+	}
+	return db, nil
+}
+
+// Migrator returns what's needed to bring the database schema up to date.
+func Migrator(db *sql.DB) (*migrate.Migrator, error) {
+	schema, err := migrate.Load(migrations, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	return migrate.New(db, schema), nil
+}
+
+// Open opens the database file, making sure the schema is up to date, and migrating it if autoMigrate is set.
+func Open(path string, autoMigrate bool) (*Sink, error) {
+	db, err := Connect(path)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debug("Database Migration (if needed)")
+	migrator, err := Migrator(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	if _, err := migrator.Ready(autoMigrate); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &Sink{db: db}, nil
+}
+
+// Write inserts a row for every client and AP in the snapshot, all in one transaction.
+func (s *Sink) Write(snapshot *store.Snapshot) error {
+	err := s.write(snapshot)
+	if transient(err) {
+		return store.Transient(err)
+	}
+	return err
+}
+
+// write is Write, without working out whether any error is worth trying again.
+func (s *Sink) write(snapshot *store.Snapshot) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	timestamp := snapshot.Time.UTC().Format(TimeFormat)
+
+	stmt, err := tx.Prepare(sqlInsertClient)
+	if err != nil {
+		return fmt.Errorf("insert into clients: %w", err)
+	}
+	defer stmt.Close()
+	for _, data := range snapshot.Clients {
+		if _, err := stmt.Exec(
+			timestamp,
+			snapshot.Controller,
+			data.APMAC,
+			data.IP,
+			data.MAC,
+			data.SSID,
+			data.User,
+			data.Proto,
+			data.RSSI,
+			data.SNR,
+			data.BytesRecv,
+			data.BytesSent,
+		); err != nil {
+			return fmt.Errorf("insert into clients: %w", err)
+		}
+	}
+
+	stmt, err = tx.Prepare(sqlInsertAP)
+	if err != nil {
+		return fmt.Errorf("insert into aps: %w", err)
+	}
+	defer stmt.Close()
+	for _, data := range snapshot.APs {
+		if _, err := stmt.Exec(
+			timestamp,
+			snapshot.Controller,
+			data.MAC,
+			data.Name,
+			data.Channel24GHz,
+			data.Channel5GHz,
+		); err != nil {
+			return fmt.Errorf("insert into aps: %w", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// transient is whether a write that failed with err might work if tried again, because the error was down to the
+// database file being locked, or the disk it's on, rather than what was being written.
+func transient(err error) bool {
+	var sqliteErr interface{ Code() int }
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	// extended result codes keep the primary one in the bottom byte
+	switch sqliteErr.Code() & 0xff {
+	case sqlite3.SQLITE_BUSY, sqlite3.SQLITE_LOCKED, sqlite3.SQLITE_NOMEM, sqlite3.SQLITE_IOERR, sqlite3.SQLITE_FULL,
+		sqlite3.SQLITE_CANTOPEN:
+		return true
+	}
+	return false
+}
+
+// Close closes the database.
+func (s *Sink) Close() error {
+	return s.db.Close()
+}
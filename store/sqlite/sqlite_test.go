@@ -0,0 +1,67 @@
+package sqlite
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dotwaffle/wifitracker/decoder"
+	"github.com/dotwaffle/wifitracker/store"
+)
+
+func TestWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wifitracker.db")
+	sink, err := Open(path, true)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer sink.Close()
+
+	var mode string
+	if err := sink.db.QueryRow("PRAGMA journal_mode").Scan(&mode); err != nil || mode != "wal" {
+		t.Errorf("journal_mode: got %q, %v", mode, err)
+	}
+
+	at := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	var wg sync.WaitGroup
+	for _, controller := range []string{"wlc1", "wlc2", "wlc3"} {
+		wg.Add(1)
+		go func(controller string) {
+			defer wg.Done()
+			if err := sink.Write(&store.Snapshot{
+				Controller: controller,
+				Time:       at,
+				Clients:    []decoder.Client{{APMAC: "003a98aabbcc", MAC: "001122334455", RSSI: -61}},
+				APs:        []decoder.AP{{MAC: "003a98aabbcc", Name: "ap-lobby", Channel24GHz: 6}},
+			}); err != nil {
+				t.Errorf("%s: Write: %v", controller, err)
+			}
+		}(controller)
+	}
+	wg.Wait()
+
+	var clients, aps int
+	var timestamp string
+	if err := sink.db.QueryRow("SELECT COUNT(*), MIN(timestamp) FROM clients").Scan(&clients, &timestamp); err != nil {
+		t.Fatalf("QueryRow: %v", err)
+	}
+	if err := sink.db.QueryRow("SELECT COUNT(*) FROM aps").Scan(&aps); err != nil {
+		t.Fatalf("QueryRow: %v", err)
+	}
+	if clients != 3 || aps != 3 {
+		t.Errorf("got %d clients and %d aps, want 3 of each", clients, aps)
+	}
+	if timestamp != "2017-06-01 12:00:00" {
+		t.Errorf("got timestamp %q", timestamp)
+	}
+
+	// opening it again leaves everything where it was
+	sink.Close()
+	if sink, err = Open(path, false); err != nil {
+		t.Fatalf("Open again: %v", err)
+	}
+	if err := sink.db.QueryRow("SELECT COUNT(*) FROM clients").Scan(&clients); err != nil || clients != 3 {
+		t.Errorf("after reopening: got %d clients, %v", clients, err)
+	}
+}
@@ -0,0 +1,151 @@
+// Package store is where the clients and APs found by each poll end up.
+//
+// Every storage backend is a Sink. Several can be active at once by wrapping them in a Multi, which the collectors
+// write to without knowing or caring what's behind it.
+package store
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/dotwaffle/wifitracker/decoder"
+)
+
+// Snapshot is everything found by a single poll of a controller.
+type Snapshot struct {
+	Controller string           `json:"controller"`
+	Time       time.Time        `json:"time"`
+	Clients    []decoder.Client `json:"clients"`
+	APs        []decoder.AP     `json:"aps"`
+}
+
+// Rows is how many rows the snapshot takes up in a database.
+func (s *Snapshot) Rows() int {
+	return len(s.Clients) + len(s.APs)
+}
+
+// Sink stores snapshots somewhere.
+//
+// Write is called by every collector, so must be safe to call concurrently.
+type Sink interface {
+	Write(s *Snapshot) error
+	Close() error
+}
+
+// Multi writes every snapshot to a number of sinks.
+type Multi struct {
+	names []string
+	sinks []Sink
+}
+
+// Add starts writing to another sink, which is named in any errors it returns.
+func (m *Multi) Add(name string, s Sink) {
+	m.names = append(m.names, name)
+	m.sinks = append(m.sinks, s)
+}
+
+// Len is the number of sinks being written to.
+func (m *Multi) Len() int {
+	return len(m.sinks)
+}
+
+// Write writes the snapshot to every sink, even if some of them fail.
+func (m *Multi) Write(s *Snapshot) error {
+	var errs MultiError
+	for i, sink := range m.sinks {
+		if err := sink.Write(s); err != nil {
+			errs = append(errs, &SinkError{Sink: m.names[i], Err: err})
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Close closes every sink, even if some of them fail.
+func (m *Multi) Close() error {
+	var errs MultiError
+	for i, sink := range m.sinks {
+		if err := sink.Close(); err != nil {
+			errs = append(errs, &SinkError{Sink: m.names[i], Err: err})
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// SinkError is a failure of one of the sinks in a Multi.
+type SinkError struct {
+	Sink string
+	Err  error
+}
+
+func (e *SinkError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Sink, e.Err)
+}
+
+// Unwrap returns what went wrong with the sink.
+func (e *SinkError) Unwrap() error {
+	return e.Err
+}
+
+// MultiError is every failure from a single Write or Close of a Multi.
+type MultiError []error
+
+func (e MultiError) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// TransientError is a write that failed because of where it was going rather than what was being written, such as a
+// database that's down or too busy, so is worth trying again later.
+type TransientError struct {
+	Err error
+}
+
+func (e *TransientError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns what went wrong with the write.
+func (e *TransientError) Unwrap() error {
+	return e.Err
+}
+
+// Transient marks an error a Sink knows to be worth trying again, returning nil if there wasn't one.
+func Transient(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &TransientError{Err: err}
+}
+
+// IsTransient is whether a write that failed might work if tried again later: because the Sink marked the error
+// with Transient, or because somewhere behind it is a lost connection, timeout or I/O error. Anything else means the
+// snapshot itself was refused, and will be however many times it's tried.
+func IsTransient(err error) bool {
+	var transient *TransientError
+	var netErr net.Error
+	var pathErr *fs.PathError
+	return errors.As(err, &transient) ||
+		errors.As(err, &netErr) ||
+		errors.As(err, &pathErr) ||
+		errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, sql.ErrConnDone) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, context.DeadlineExceeded)
+}
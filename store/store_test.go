@@ -0,0 +1,77 @@
+package store
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"testing"
+)
+
+// recorder is a sink that remembers what was written to it.
+type recorder struct {
+	written []*Snapshot
+	err     error
+	closed  bool
+}
+
+func (r *recorder) Write(s *Snapshot) error {
+	r.written = append(r.written, s)
+	return r.err
+}
+
+func (r *recorder) Close() error {
+	r.closed = true
+	return r.err
+}
+
+func TestMulti(t *testing.T) {
+	broken := errors.New("disk on fire")
+	good, bad, later := &recorder{}, &recorder{err: broken}, &recorder{}
+	m := &Multi{}
+	m.Add("good", good)
+	m.Add("bad", bad)
+	m.Add("later", later)
+
+	s := &Snapshot{Controller: "wlc1"}
+	err := m.Write(s)
+	var errs MultiError
+	if !errors.As(err, &errs) || len(errs) != 1 {
+		t.Fatalf("Write: got %v, want a single failure", err)
+	}
+	var sinkErr *SinkError
+	if !errors.As(errs[0], &sinkErr) || sinkErr.Sink != "bad" || !errors.Is(sinkErr, broken) {
+		t.Errorf("Write: got %v, want the bad sink's error", errs[0])
+	}
+	for name, r := range map[string]*recorder{"good": good, "bad": bad, "later": later} {
+		if len(r.written) != 1 || r.written[0] != s {
+			t.Errorf("%s: got %d snapshots, want the one written", name, len(r.written))
+		}
+	}
+
+	if err := m.Close(); err == nil {
+		t.Errorf("Close: didn't report the bad sink")
+	}
+	if !good.closed || !bad.closed || !later.closed {
+		t.Errorf("Close: not every sink was closed")
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	for err, want := range map[error]bool{
+		Transient(errors.New("too many connections")):                      true,
+		fmt.Errorf("commit: %w", &net.OpError{Op: "dial", Err: io.EOF}):    true,
+		fmt.Errorf("insert: %w", driver.ErrBadConn):                        true,
+		&fs.PathError{Op: "write", Path: "/var/log/wifi.log", Err: io.EOF}: true,
+		errors.New("column clientssid is too long"):                        false,
+	} {
+		if got := IsTransient(err); got != want {
+			t.Errorf("IsTransient(%v) = %v, want %v", err, got, want)
+		}
+	}
+	if Transient(nil) != nil {
+		t.Errorf("Transient(nil) isn't nil")
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/dotwaffle/wifitracker/store"
+	"github.com/dotwaffle/wifitracker/store/migrate"
+)
+
+// how long to wait before trying again after something has failed, doubling each time it fails again
+var (
+	minBackoff = 1 * time.Second
+	maxBackoff = 5 * time.Minute
+)
+
+// exitConfig is the exit code when the configuration is wrong, as opposed to something having broken along the way,
+// so that whatever restarts wifitracker can tell there's no point.
+const exitConfig = 2
+
+// a configError can't be fixed by trying again, only by fixing the configuration.
+type configError struct {
+	err error
+}
+
+func (e *configError) Error() string {
+	return e.err.Error()
+}
+
+func (e *configError) Unwrap() error {
+	return e.err
+}
+
+// unrecoverable reports whether trying again can't possibly help.
+func unrecoverable(err error) bool {
+	var config *configError
+	return errors.As(err, &config) || errors.Is(err, migrate.ErrTooNew) || errors.Is(err, migrate.ErrPending)
+}
+
+// backoff is how long to wait between attempts at something that keeps failing.
+type backoff struct {
+	next time.Duration
+}
+
+// duration is how long the next wait will be.
+func (b *backoff) duration() time.Duration {
+	if b.next < minBackoff {
+		return minBackoff
+	}
+	return b.next
+}
+
+// wait sleeps for the current backoff, and doubles it for next time, returning early with the context's error if it's
+// cancelled.
+func (b *backoff) wait(ctx context.Context) error {
+	d := b.duration()
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+	}
+	if b.next = 2 * d; b.next > maxBackoff {
+		b.next = maxBackoff
+	}
+	return nil
+}
+
+// reset goes back to the shortest backoff, once things are working again.
+func (b *backoff) reset() {
+	b.next = 0
+}
+
+// retry runs fn until it succeeds, backing off in between, giving up only if it fails in a way that can't be fixed
+// by trying again, or the context is cancelled.
+func retry(ctx context.Context, logger *log.Entry, what string, fn func() error) error {
+	var b backoff
+	for {
+		err := fn()
+		if err == nil || unrecoverable(err) {
+			return err
+		}
+		logger.WithFields(log.Fields{
+			"err":   err,
+			"retry": b.duration().String(),
+		}).Warn(what + " failed, will retry")
+		if err := b.wait(ctx); err != nil {
+			return err
+		}
+	}
+}
+
+// supervise keeps the controller's collector running, reconnecting to the controller with a backoff whenever it
+// stops answering. It only returns once replaying has finished, the controller's configuration is unusable, or the
+// context is cancelled. New settings from reloading the configuration are applied between polls.
+func (c *controller) supervise(ctx context.Context, sink store.Sink) error {
+	defer c.close()
+	if err := c.check(); err != nil {
+		return &configError{err}
+	}
+
+	var b backoff
+	for {
+		// the settings can change while waiting to reconnect, too
+		select {
+		case c.pending = <-c.updates:
+		default:
+		}
+		if c.pending != nil {
+			c.reconfigured()
+		}
+
+		// there's nobody to talk to when replaying
+		if c.player == nil && c.snmp == nil {
+			if err := c.connect(); err != nil {
+				if unrecoverable(err) {
+					return err
+				}
+				c.log.WithFields(log.Fields{
+					"host":    c.host,
+					"version": c.version,
+					"user":    c.usm.user,
+					"timeout": c.timeout,
+					"retries": c.retries,
+					"err":     err,
+					"retry":   b.duration().String(),
+				}).Error("Couldn't open SNMP session, will retry")
+				status.connected(c.name, err)
+				if err := b.wait(ctx); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		status.connected(c.name, nil)
+
+		started := time.Now()
+		err := c.run(ctx, sink)
+		if errors.Is(err, errReconfigure) {
+			continue
+		}
+		if errors.Is(err, errReplayFinished) || unrecoverable(err) || ctx.Err() != nil {
+			return err
+		}
+		// it got going before it stopped, so this is a fresh problem
+		if c.lastSuccess.After(started) {
+			b.reset()
+		}
+
+		// start again with a fresh session
+		status.connected(c.name, err)
+		c.log.WithFields(log.Fields{
+			"err":   err,
+			"retry": b.duration().String(),
+		}).Error("Collector stopped, restarting")
+		if err := c.close(); err != nil {
+			c.log.WithFields(log.Fields{
+				"err": err,
+			}).Warn("Couldn't close SNMP socket")
+		}
+		c.snmp = nil
+		if err := b.wait(ctx); err != nil {
+			return err
+		}
+	}
+}
+
+// reconfigured applies the settings that were waiting to be picked up, closing the SNMP sessions if they need opening
+// again to use them.
+func (c *controller) reconfigured() {
+	reconnect := c.apply(c.pending)
+	c.pending = nil
+	if reconnect {
+		if err := c.close(); err != nil {
+			c.log.WithFields(log.Fields{
+				"err": err,
+			}).Warn("Couldn't close SNMP socket")
+		}
+		c.snmp = nil
+	}
+	c.log.WithFields(log.Fields{
+		"reconnect": reconnect,
+	}).Info("Controller settings changed")
+}
+
+// pollers keeps a collector running for each controller, starting and stopping them as controllers come and go with
+// the configuration.
+type pollers struct {
+	ctx     context.Context
+	sink    store.Sink
+	running map[string]*poller
+	exits   chan exit
+	live    int // collectors that haven't exited yet, including those being stopped
+}
+
+// poller is a running collector, and how to stop it.
+type poller struct {
+	c        *controller
+	settings *controller // the settings last handed to the collector, as it changes c's own as it picks them up
+	stop     context.CancelFunc
+}
+
+// exit is a collector having stopped, and why.
+type exit struct {
+	c   *controller
+	err error
+}
+
+func newPollers(ctx context.Context, sink store.Sink) *pollers {
+	return &pollers{
+		ctx:     ctx,
+		sink:    sink,
+		running: make(map[string]*poller),
+		exits:   make(chan exit),
+	}
+}
+
+// start runs a collector for the controller, until it stops for good or is stopped.
+func (p *pollers) start(c *controller) {
+	ctx, stop := context.WithCancel(p.ctx)
+	settings := newController(c.name, c.host)
+	settings.apply(c)
+	p.running[c.name] = &poller{c: c, settings: settings, stop: stop}
+	p.live++
+	status.watch(c.name, c.pollInterval)
+	go func() {
+		err := c.supervise(ctx, p.sink)
+		switch {
+		case errors.Is(err, errReplayFinished):
+			c.log.Info("Collector finished replaying snapshots")
+		case errors.Is(err, context.Canceled):
+			c.log.Debug("Collector stopped")
+		default:
+			c.log.WithFields(log.Fields{
+				"host":    c.host,
+				"version": c.version,
+				"err":     err,
+			}).Error("Collector can't run with its configuration!")
+		}
+		p.exits <- exit{c: c, err: err}
+	}()
+}
+
+// stop stops the named controller's collector, without waiting for its polls to finish.
+func (p *pollers) stop(name string) {
+	p.running[name].stop()
+	delete(p.running, name)
+	status.forget(name)
+}
+
+// exited deals with a collector having stopped, returning its error if it shouldn't have.
+func (p *pollers) exited(e exit) error {
+	p.live--
+	// it was stopped on purpose
+	if running, ok := p.running[e.c.name]; !ok || running.c != e.c {
+		return nil
+	}
+	p.stop(e.c.name)
+	if errors.Is(e.err, errReplayFinished) {
+		return nil
+	}
+	return e.err
+}
+
+// update brings the running collectors into line with the controllers: stopping those that have gone, starting new
+// ones, and handing the rest their new settings.
+func (p *pollers) update(controllers []*controller) {
+	wanted := make(map[string]bool)
+	for _, c := range controllers {
+		wanted[c.name] = true
+	}
+	for name, running := range p.running {
+		if !wanted[name] {
+			running.c.log.Info("Controller removed, stopping its collector")
+			p.stop(name)
+			registry.Delete("controller", name)
+		}
+	}
+	for _, c := range controllers {
+		if running, ok := p.running[c.name]; ok {
+			if !running.settings.sameSettings(c) {
+				running.settings = c
+				running.c.reconfigure(c)
+			}
+			continue
+		}
+		if err := c.openSnapshots(); err != nil {
+			c.log.WithFields(log.Fields{
+				"err": err,
+			}).Error("Couldn't set up SNMP snapshots, not starting collector")
+			continue
+		}
+		c.log.Info("Controller added, starting its collector")
+		p.start(c)
+	}
+}
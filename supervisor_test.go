@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/dotwaffle/wifitracker/fakeagent"
+	"github.com/dotwaffle/wifitracker/store"
+	"github.com/dotwaffle/wifitracker/store/migrate"
+)
+
+// brokenSink fails every write, counting them.
+type brokenSink struct {
+	mu     sync.Mutex
+	writes int
+}
+
+func (s *brokenSink) Write(*store.Snapshot) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.writes++
+	return errors.New("database is down")
+}
+
+func (s *brokenSink) Close() error {
+	return nil
+}
+
+func TestRunSurvivesStorageFailures(t *testing.T) {
+	scenario, err := fakeagent.LoadScenario("fakeagent/testdata/roaming.json")
+	if err != nil {
+		t.Fatalf("LoadScenario: %v", err)
+	}
+	agent, err := fakeagent.Start("127.0.0.1:0", "public", scenario)
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	c := testController(t, agent)
+	c.pollInterval = 20 * time.Millisecond
+	c.snmp.Timeout = 50 * time.Millisecond
+
+	// the controller goes away once a few polls have failed to be stored
+	sink := &brokenSink{}
+	go func() {
+		for {
+			time.Sleep(10 * time.Millisecond)
+			sink.mu.Lock()
+			writes := sink.writes
+			sink.mu.Unlock()
+			if writes >= 3 {
+				agent.Close()
+				return
+			}
+		}
+	}()
+
+	done := make(chan error)
+	go func() { done <- c.run(context.Background(), sink) }()
+	select {
+	case err := <-done:
+		if !errors.Is(err, errNoResponse) {
+			t.Errorf("run: got %v, want errNoResponse", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("run didn't notice the controller going away")
+	}
+	if !c.lastSuccess.IsZero() {
+		t.Errorf("lastSuccess set, but nothing was stored")
+	}
+}
+
+func TestSuperviseConfigError(t *testing.T) {
+	c := newController("broken", "127.0.0.1")
+	c.version = "4"
+	err := c.supervise(context.Background(), &brokenSink{})
+	var config *configError
+	if !errors.As(err, &config) {
+		t.Errorf("supervise: got %v, want a configError", err)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	defer func(min, max time.Duration) { minBackoff, maxBackoff = min, max }(minBackoff, maxBackoff)
+	minBackoff, maxBackoff = time.Millisecond, 4*time.Millisecond
+
+	var attempts int
+	err := retry(context.Background(), log.WithFields(log.Fields{"test": t.Name()}), "Testing", func() error {
+		if attempts++; attempts < 5 {
+			return errors.New("not yet")
+		}
+		return nil
+	})
+	if err != nil || attempts != 5 {
+		t.Errorf("retry: got %v after %d attempts, want success after 5", err, attempts)
+	}
+
+	attempts = 0
+	err = retry(context.Background(), log.WithFields(log.Fields{"test": t.Name()}), "Testing", func() error {
+		attempts++
+		return fmt.Errorf("opening: %w", migrate.ErrTooNew)
+	})
+	if !errors.Is(err, migrate.ErrTooNew) || attempts != 1 {
+		t.Errorf("retry: got %v after %d attempts, want ErrTooNew straight away", err, attempts)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	defer func(min, max time.Duration) { minBackoff, maxBackoff = min, max }(minBackoff, maxBackoff)
+	minBackoff, maxBackoff = time.Millisecond, 4*time.Millisecond
+
+	var b backoff
+	var got []time.Duration
+	for i := 0; i < 5; i++ {
+		got = append(got, b.duration())
+		b.wait(context.Background())
+	}
+	want := []time.Duration{1, 2, 4, 4, 4}
+	for i := range want {
+		if got[i] != want[i]*time.Millisecond {
+			t.Errorf("got backoffs %v", got)
+			break
+		}
+	}
+	b.reset()
+	if b.duration() != minBackoff {
+		t.Errorf("after reset: got %v, want %v", b.duration(), minBackoff)
+	}
+}
+
+func TestSuperviseStopsWhenCancelled(t *testing.T) {
+	scenario, err := fakeagent.LoadScenario("fakeagent/testdata/roaming.json")
+	if err != nil {
+		t.Fatalf("LoadScenario: %v", err)
+	}
+	agent, err := fakeagent.Start("127.0.0.1:0", "public", scenario)
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer agent.Close()
+
+	for _, schedule := range []string{scheduleSkip, scheduleConcurrent} {
+		c := newController("wlc", agent.Addr().IP.String())
+		c.port = uint16(agent.Addr().Port)
+		c.version = "2c"
+		c.community = "public"
+		c.schedule = schedule
+		c.pollInterval = 10 * time.Millisecond
+
+		// stop as soon as the first poll is being written, which has to finish before supervise returns
+		sink := &slowSink{delay: 50 * time.Millisecond}
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			for {
+				time.Sleep(time.Millisecond)
+				sink.mu.Lock()
+				running := sink.running
+				sink.mu.Unlock()
+				if running > 0 {
+					cancel()
+					return
+				}
+			}
+		}()
+
+		done := make(chan error)
+		go func() { done <- c.supervise(ctx, sink) }()
+		select {
+		case err := <-done:
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("%s: supervise: got %v, want context.Canceled", schedule, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: supervise didn't stop", schedule)
+		}
+		sink.mu.Lock()
+		if sink.running != 0 || sink.writes == 0 {
+			t.Errorf("%s: %d writes still running, %d finished", schedule, sink.running, sink.writes)
+		}
+		sink.mu.Unlock()
+	}
+}
+
+func TestWaitFor(t *testing.T) {
+	exits := make(chan exit)
+	go func() {
+		exits <- exit{}
+		exits <- exit{}
+	}()
+	if !waitFor(exits, 2, time.Second) {
+		t.Errorf("waitFor gave up on collectors that stopped")
+	}
+	if waitFor(exits, 1, 10*time.Millisecond) {
+		t.Errorf("waitFor didn't give up on a collector that never stopped")
+	}
+}
+
+func TestCloseWithin(t *testing.T) {
+	slow := &slowSink{delay: time.Second}
+	sink := &swapSink{sink: slow}
+	if err := closeWithin(sink, time.Second); err != nil {
+		t.Errorf("closeWithin: %v", err)
+	}
+
+	// a write abandoned at shutdown holds the storage up, but mustn't hold up exiting
+	go sink.Write(&store.Snapshot{})
+	for writing := false; !writing; time.Sleep(time.Millisecond) {
+		slow.mu.Lock()
+		writing = slow.running > 0
+		slow.mu.Unlock()
+	}
+	begun := time.Now()
+	if err := closeWithin(sink, 20*time.Millisecond); err == nil {
+		t.Errorf("closeWithin didn't give up")
+	}
+	if waited := time.Since(begun); waited > 500*time.Millisecond {
+		t.Errorf("closeWithin waited %v", waited)
+	}
+}
+
+func TestSuperviseReconfigure(t *testing.T) {
+	scenario, err := fakeagent.LoadScenario("fakeagent/testdata/roaming.json")
+	if err != nil {
+		t.Fatalf("LoadScenario: %v", err)
+	}
+	agent, err := fakeagent.Start("127.0.0.1:0", "public", scenario)
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer agent.Close()
+
+	// it would never poll, if it weren't for being told to poll more often
+	c := newController("wlc", agent.Addr().IP.String())
+	c.port = uint16(agent.Addr().Port)
+	c.version = "2c"
+	c.community = "public"
+	c.pollInterval = time.Hour
+	n := newController("wlc", c.host)
+	n.apply(c)
+	n.pollInterval = 10 * time.Millisecond
+
+	sink := &slowSink{}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- c.supervise(ctx, sink) }()
+	c.reconfigure(n)
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		sink.mu.Lock()
+		writes := sink.writes
+		sink.mu.Unlock()
+		if writes > 0 {
+			break
+		}
+	}
+	cancel()
+	<-done
+	if sink.writes == 0 {
+		t.Errorf("new poll interval never picked up")
+	}
+
+	// only changes to the session mean reconnecting
+	if c.apply(n) {
+		t.Errorf("reconnecting with the same session settings")
+	}
+	n.community = "private"
+	if !c.apply(n) {
+		t.Errorf("not reconnecting with a new community")
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/dotwaffle/wifitracker/decoder"
+	"github.com/dotwaffle/wifitracker/replay"
+	"github.com/gosnmp/gosnmp"
+)
+
+// walk is how walking a single OID went.
+type walk struct {
+	oid      string
+	pdus     []gosnmp.SnmpPDU
+	err      error
+	duration time.Duration
+}
+
+// oids returns the OIDs the controller's polls walk, for the columns it's set to collect.
+func (c *controller) oids() []string {
+	oids, err := decoder.Select(c.columns)
+	if err != nil {
+		// only a controller that was never checked can get here
+		return decoder.OIDs()
+	}
+	return oids
+}
+
+// walkAll walks every OID the controller's columns need, up to walkConcurrency at once, returning the walks in the
+// decoder's order whatever order they finished in. walker does some of the walks, and when walking a real controller,
+// any others running at once get a session of their own from the pool, as a session can only do one walk at a time. A
+// recording can be walked by everyone at once.
+func (c *controller) walkAll(walker replay.Walker, recorded bool) []walk {
+	oids := c.oids()
+	walks := make([]walk, len(oids))
+	next := make(chan int, len(oids))
+	for i := range oids {
+		next <- i
+	}
+	close(next)
+
+	walkers := []replay.Walker{walker}
+	for len(walkers) < c.walkConcurrency && len(walkers) < len(oids) {
+		if recorded {
+			walkers = append(walkers, walker)
+			continue
+		}
+		session, err := c.sessions.get(c.dial)
+		if err != nil {
+			c.log.WithFields(log.Fields{
+				"walkers": len(walkers),
+				"err":     err,
+			}).Warn("Couldn't open another SNMP session, walking with fewer")
+			break
+		}
+		defer c.sessions.put(session)
+		walkers = append(walkers, session)
+	}
+
+	var wg sync.WaitGroup
+	for _, w := range walkers {
+		wg.Add(1)
+		go func(w replay.Walker) {
+			defer wg.Done()
+			for i := range next {
+				timeStartWalk := time.Now()
+				pdus, err := w.BulkWalkAll(oids[i])
+				walks[i] = walk{
+					oid:      oids[i],
+					pdus:     pdus,
+					err:      err,
+					duration: time.Since(timeStartWalk),
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	return walks
+}
+
+// sessionPool keeps the extra SNMP sessions used for walking in parallel between polls.
+type sessionPool struct {
+	mu   sync.Mutex
+	idle []*gosnmp.GoSNMP
+}
+
+// get returns an idle session, or dials a new one if there aren't any.
+func (p *sessionPool) get(dial func() (*gosnmp.GoSNMP, error)) (*gosnmp.GoSNMP, error) {
+	p.mu.Lock()
+	if n := len(p.idle); n > 0 {
+		session := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.mu.Unlock()
+		return session, nil
+	}
+	p.mu.Unlock()
+	return dial()
+}
+
+// put hands a session back for another walk to use.
+func (p *sessionPool) put(session *gosnmp.GoSNMP) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.idle = append(p.idle, session)
+}
+
+// close closes every idle session.
+func (p *sessionPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, session := range p.idle {
+		session.Conn.Close()
+	}
+	p.idle = nil
+}